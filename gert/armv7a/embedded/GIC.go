@@ -155,6 +155,68 @@ func Enable_interrupt_mask(num uint32, cpumask uint8, priority uint8) {
 	gic_distributor.interrupt_set_enable_registers[num/32] = 1 << (num & 0x1F) // enable the interrupt
 }
 
+//trigger types for Configure_interrupt
+const (
+	TRIGGER_LEVEL = 0
+	TRIGGER_EDGE  = 1
+)
+
+//Each interrupt has 2 bits in the configuration registers and only the top one matters.
+//Peripherals in the iMX6 are level sensitive, SGIs are always edge triggered.
+//The GIC spec says not to change this while the interrupt is enabled, so it gets turned off for a moment.
+func Configure_interrupt(num uint32, trigger uint32) {
+	enabled := Interrupt_enabled(num)
+	Disable_interrupt(num)
+	shift := ((num & 0xF) * 2) + 1
+	config := gic_distributor.interrupt_configuration_registers[num/16]
+	config &= ^(1 << shift)
+	config |= (trigger & 0x1) << shift
+	gic_distributor.interrupt_configuration_registers[num/16] = config
+	if enabled {
+		Reenable_interrupt(num)
+	}
+}
+
+func Interrupt_trigger(num uint32) uint32 {
+	shift := ((num & 0xF) * 2) + 1
+	return (gic_distributor.interrupt_configuration_registers[num/16] >> shift) & 0x1
+}
+
+//Stops the GIC from forwarding interrupt num. Its priority and targets are left alone.
+func Disable_interrupt(num uint32) {
+	gic_distributor.interrupt_clear_enable_registers[num/32] = 1 << (num & 0x1F)
+	runtime.DMB()
+}
+
+//Undoes Disable_interrupt without touching the priority or targets
+func Reenable_interrupt(num uint32) {
+	gic_distributor.interrupt_set_enable_registers[num/32] = 1 << (num & 0x1F)
+}
+
+func Interrupt_enabled(num uint32) bool {
+	return (gic_distributor.interrupt_set_enable_registers[num/32] & (1 << (num & 0x1F))) != 0
+}
+
+//Makes interrupt num pending as if the peripheral had raised it
+func Set_pending(num uint32) {
+	gic_distributor.interrupt_set_pending_registers[num/32] = 1 << (num & 0x1F)
+}
+
+//Throws away a pending interrupt. A level sensitive interrupt will come right back
+//unless the peripheral has been cleared first.
+func Clear_pending(num uint32) {
+	gic_distributor.interrupt_clear_pending_registers[num/32] = 1 << (num & 0x1F)
+}
+
+func Interrupt_pending(num uint32) bool {
+	return (gic_distributor.interrupt_set_pending_registers[num/32] & (1 << (num & 0x1F))) != 0
+}
+
+//An interrupt is active from when a cpu acknowledges it until that cpu writes the EOI
+func Interrupt_active(num uint32) bool {
+	return (gic_distributor.active_bit_registers[num/32] & (1 << (num & 0x1F))) != 0
+}
+
 func Sgi(num uint32, cpus uint32) {
 	gic_distributor.software_generated_interrupt_register = ((cpus & 0xFF) << 16) | (num & 0xF)
 }
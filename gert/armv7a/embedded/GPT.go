@@ -6,6 +6,8 @@ package embedded
 
 import "unsafe"
 import "fmt"
+import "errors"
+import "sync"
 
 /*
 209_8000 GPT Control Register (GPT_CR) 32 R/W 0000_0000h 30.6.1/1499
@@ -35,6 +37,8 @@ type GPT struct {
 
 var gpt *GPT = (*GPT)(unsafe.Pointer(uintptr(0x2098000)))
 
+const GPT_IRQ = 87
+
 func StartGPT() bool {
 	fmt.Printf("GPT lives at %x\r\n", gpt)
 	gpt.CR = 0
@@ -47,6 +51,231 @@ func StartGPT() bool {
 	return true
 }
 
+//clears every status flag, not just output compare 1
+//go:nosplit
 func ClearGPTIntr() {
-	gpt.SR = 0x1
+	gpt.SR = GPT_SR_ALL
+}
+
+//Runs handler on cpunum every time the GPT interrupts. The status register is cleared for you.
+func EnableGPTIntr(cpunum uint32, priority uint8, handler Interrupt_handler) {
+	Register_interrupt(GPT_IRQ, cpunum, priority, handler, ClearGPTIntr)
+}
+
+/*
+* The rest of this file is a GPT driver which runs the counter freely off the 24MHz crystal
+* and gives out the three output compare and two input capture channels separately.
+* GPT_ISR clears the flags and calls the handler for each channel that fired.
+* Section 30 of the iMX6 Quad Applications Manual
+ */
+
+const (
+	GPT_CRYSTAL_HZ = 24000000
+	GPT_PRIORITY   = 0x40
+
+	//CR
+	GPT_CR_EN     = 1 << 0
+	GPT_CR_ENMOD  = 1 << 1
+	GPT_CR_DBGEN  = 1 << 2
+	GPT_CR_WAITEN = 1 << 3
+	GPT_CR_STOPEN = 1 << 5
+	GPT_CR_FRR    = 1 << 9
+	GPT_CR_EN_24M = 1 << 10
+	GPT_CR_SWR    = 1 << 15
+	GPT_CLK_24M   = 0x5 << 6
+
+	//SR and IR share the same layout
+	GPT_SR_OF1 = 1 << 0
+	GPT_SR_IF1 = 1 << 3
+	GPT_SR_ROV = 1 << 5
+	GPT_SR_ALL = 0x3F
+)
+
+//input capture edges
+const (
+	GPT_CAPTURE_DISABLED = 0
+	GPT_CAPTURE_RISING   = 1
+	GPT_CAPTURE_FALLING  = 2
+	GPT_CAPTURE_BOTH     = 3
+)
+
+//what the output compare pins do on a match
+const (
+	GPT_OUTPUT_DISCONNECTED = 0
+	GPT_OUTPUT_TOGGLE       = 1
+	GPT_OUTPUT_CLEAR        = 2
+	GPT_OUTPUT_SET          = 3
+	GPT_OUTPUT_PULSE        = 4
+)
+
+//Called from GPT_ISR with the channel (1-3 for compares, 1-2 for captures)
+//and the value of the compare or capture register. Runs in IRQ mode.
+type GPT_handler func(channel uint32, count uint32)
+
+type gpt_compare_channel struct {
+	handler GPT_handler
+	period  uint32
+}
+
+var gpt_ocr = [3]*uint32{&gpt.OCR1, &gpt.OCR2, &gpt.OCR3}
+var gpt_icr = [2]*uint32{&gpt.ICR1, &gpt.ICR2}
+var gpt_compares [3]gpt_compare_channel
+var gpt_captures [2]GPT_handler
+var gpt_hz uint32
+var gpt_ir_lock sync.Mutex
+
+//Resets the GPT and starts it counting up at tick_hz from the 24MHz crystal.
+//The counter runs freely and wraps at 2^32, so the compare channels dont disturb each other.
+//The GPT interrupt goes to GPT_ISR on CPU0. Use Register_interrupt(GPT_IRQ, ...) to move it.
+func GPT_begin(tick_hz uint32) error {
+	if tick_hz == 0 || tick_hz > GPT_CRYSTAL_HZ {
+		return errors.New("GPT tick frequency out of range")
+	}
+	div := (GPT_CRYSTAL_HZ + tick_hz/2) / tick_hz
+	if div > 16*4096 {
+		return errors.New("GPT tick frequency too low")
+	}
+	//split the divider between the 4bit crystal prescaler and the 12bit main prescaler
+	pre24 := uint32(1)
+	for div/pre24 > 4096 || div%pre24 != 0 {
+		pre24++
+		if pre24 > 16 {
+			pre24 = (div + 4095) / 4096
+			break
+		}
+	}
+	pre := div / pre24
+
+	gpt.CR = 0
+	gpt.IR = 0
+	gpt.CR = GPT_CR_SWR
+	for gpt.CR&GPT_CR_SWR != 0 {
+	}
+	gpt.CR = GPT_CLK_24M | GPT_CR_EN_24M | GPT_CR_FRR | GPT_CR_ENMOD | GPT_CR_WAITEN | GPT_CR_STOPEN | GPT_CR_DBGEN
+	gpt.PR = ((pre24 - 1) << 12) | (pre - 1)
+	gpt.SR = GPT_SR_ALL
+	gpt_compares = [3]gpt_compare_channel{}
+	gpt_captures = [2]GPT_handler{}
+	gpt_hz = GPT_CRYSTAL_HZ / (pre24 * pre)
+
+	Register_interrupt(GPT_IRQ, 0, GPT_PRIORITY, GPT_ISR, nil)
+	gpt.CR |= GPT_CR_EN
+	return nil
+}
+
+//the real tick frequency after rounding the prescalers
+func GPT_tick_hz() uint32 {
+	return gpt_hz
+}
+
+//go:nosplit
+func GPT_now() uint32 {
+	return gpt.CNT
+}
+
+//Calls handler delay ticks from now on output compare channel 1-3.
+//If period is not 0 the event repeats every period ticks after that.
+func GPT_set_compare(channel uint32, delay uint32, period uint32, handler GPT_handler) error {
+	if channel < 1 || channel > 3 {
+		return errors.New("GPT compare channel must be 1, 2 or 3")
+	}
+	bit := uint32(GPT_SR_OF1 << (channel - 1))
+	gpt_ir_update(bit, 0)
+	gpt_compares[channel-1] = gpt_compare_channel{handler, period}
+	*gpt_ocr[channel-1] = gpt.CNT + delay
+	gpt.SR = bit
+	gpt_ir_update(0, bit)
+	return nil
+}
+
+func GPT_cancel_compare(channel uint32) {
+	if channel < 1 || channel > 3 {
+		return
+	}
+	bit := uint32(GPT_SR_OF1 << (channel - 1))
+	gpt_ir_update(bit, 0)
+	gpt.SR = bit
+	gpt_compares[channel-1] = gpt_compare_channel{}
+}
+
+//Sets what the GPT_COMPAREn pin does on a match. The pin still has to be muxed in the IOMUX.
+func GPT_set_output_mode(channel uint32, mode uint32) error {
+	if channel < 1 || channel > 3 {
+		return errors.New("GPT compare channel must be 1, 2 or 3")
+	}
+	shift := 20 + 3*(channel-1)
+	gpt.CR = (gpt.CR & ^(uint32(0x7) << shift)) | ((mode & 0x7) << shift)
+	return nil
+}
+
+//Latches the counter into ICRn on the given edge of the GPT_CAPTUREn pin and
+//calls handler with the latched value. The pin still has to be muxed in the IOMUX.
+func GPT_set_capture(channel uint32, edge uint32, handler GPT_handler) error {
+	if channel < 1 || channel > 2 {
+		return errors.New("GPT capture channel must be 1 or 2")
+	}
+	bit := uint32(GPT_SR_IF1 << (channel - 1))
+	shift := 16 + 2*(channel-1)
+	gpt_ir_update(bit, 0)
+	gpt_captures[channel-1] = handler
+	gpt.CR = (gpt.CR & ^(uint32(0x3) << shift)) | ((edge & 0x3) << shift)
+	gpt.SR = bit
+	if edge != GPT_CAPTURE_DISABLED && handler != nil {
+		gpt_ir_update(0, bit)
+	}
+	return nil
+}
+
+//GPT_ISR changes IR too, maybe on another cpu, so the GPT interrupt is held off in the GIC
+//and any handler already running gets to finish before we read IR.
+//That means the GPT functions cant be called from a GPT_handler, use a period for repeating events instead.
+func gpt_ir_update(clear, set uint32) {
+	gpt_ir_lock.Lock()
+	defer gpt_ir_lock.Unlock()
+	enabled := Interrupt_enabled(GPT_IRQ)
+	Disable_interrupt(GPT_IRQ)
+	for Interrupt_active(GPT_IRQ) {
+	}
+	gpt.IR = (gpt.IR &^ clear) | set
+	if enabled {
+		Reenable_interrupt(GPT_IRQ)
+	}
+}
+
+//the last value latched by capture channel 1 or 2
+func GPT_read_capture(channel uint32) uint32 {
+	if channel < 1 || channel > 2 {
+		return 0
+	}
+	return *gpt_icr[channel-1]
+}
+
+//go:nosplit
+//go:nowritebarrierec
+func GPT_ISR(irqnum uint32) {
+	status := gpt.SR & gpt.IR
+	gpt.SR = status
+	for i := uint32(0); i < 3; i++ {
+		if status&(GPT_SR_OF1<<i) == 0 {
+			continue
+		}
+		ocr := *gpt_ocr[i]
+		compare := gpt_compares[i]
+		if compare.period != 0 {
+			*gpt_ocr[i] = ocr + compare.period
+		} else {
+			gpt.IR &= ^uint32(GPT_SR_OF1 << i)
+		}
+		if compare.handler != nil {
+			compare.handler(i+1, ocr)
+		}
+	}
+	for i := uint32(0); i < 2; i++ {
+		if status&(GPT_SR_IF1<<i) == 0 {
+			continue
+		}
+		if handler := gpt_captures[i]; handler != nil {
+			handler(i+1, *gpt_icr[i])
+		}
+	}
 }
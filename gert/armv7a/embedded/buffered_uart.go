@@ -0,0 +1,203 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package embedded
+
+import "runtime"
+import "sync"
+import "sync/atomic"
+
+/*
+* A UART that moves bytes in and out of its FIFOs from its interrupt instead of busy waiting.
+* The ISR fills an RX ring and empties a TX ring. Read and Write only touch the rings,
+* and a goroutine waiting on the uart parks on a Wakeup that the ISR signals instead of spinning on usr1.
+* RX interrupts come when the FIFO reaches BUFFERED_UART_RXTL or, for the last few bytes
+* of a message, when the line has been idle for 8 characters (the aging timer).
+ */
+
+const (
+	UART_UCR1_TRDYEN = 1 << 13
+	UART_UCR1_RRDYEN = 1 << 9
+	UART_UCR2_ATEN   = 1 << 3
+	UART_USR1_AGTIM  = 1 << 8
+	UART_USR2_RDR    = 1 << 0
+	UART_URXD_ERR    = 1 << 14
+
+	BUFFERED_UART_RXTL = 16
+)
+
+//A byte queue with one producer and one consumer, where either side can be an ISR
+type byte_ring struct {
+	buf  []byte
+	mask uint32
+	head uint32
+	tail uint32
+}
+
+func make_byte_ring(size uint32) byte_ring {
+	n := uint32(1)
+	for n < size {
+		n <<= 1
+	}
+	return byte_ring{buf: make([]byte, n), mask: n - 1}
+}
+
+//go:nosplit
+func (r *byte_ring) put(c byte) bool {
+	head := atomic.LoadUint32(&r.head)
+	if head-atomic.LoadUint32(&r.tail) > r.mask {
+		return false
+	}
+	r.buf[head&r.mask] = c
+	atomic.StoreUint32(&r.head, head+1)
+	return true
+}
+
+//go:nosplit
+func (r *byte_ring) get() (byte, bool) {
+	tail := atomic.LoadUint32(&r.tail)
+	if tail == atomic.LoadUint32(&r.head) {
+		return 0, false
+	}
+	c := r.buf[tail&r.mask]
+	atomic.StoreUint32(&r.tail, tail+1)
+	return c, true
+}
+
+//go:nosplit
+func (r *byte_ring) len() uint32 {
+	return atomic.LoadUint32(&r.head) - atomic.LoadUint32(&r.tail)
+}
+
+type Buffered_UART struct {
+	uart       *UART
+	rx         byte_ring
+	tx         byte_ring
+	rlock      sync.Mutex
+	wlock      sync.Mutex
+	rx_dropped uint32
+	rx_errors  uint32
+	rx_wake    Wakeup
+	tx_wake    Wakeup
+}
+
+//Takes over u, which should already be set up by Begin or u-boot, and routes its interrupt to cpunum.
+//Both rings hold size bytes, rounded up to a power of 2.
+//Once this is called only use u through the returned Buffered_UART.
+func MakeBufferedUART(u *UART, size uint32, cpunum uint32, priority uint8) *Buffered_UART {
+	b := &Buffered_UART{uart: u, rx: make_byte_ring(size), tx: make_byte_ring(size)}
+	u.Flush()
+	u.regs.ufcr = (u.regs.ufcr &^ 0x3F) | BUFFERED_UART_RXTL
+	u.regs.ucr2 |= UART_UCR2_ATEN
+	u.regs.usr1 = UART_USR1_AGTIM
+	Register_interrupt(u.irq, cpunum, priority, b.isr, nil)
+	u.regs.ucr1 |= UART_UCR1_RRDYEN
+	return b
+}
+
+//Nothing else ever clears TRDYEN, and Write always sets it after filling the ring.
+//If Write sets it just before we clear it, the second look at the ring catches that.
+//go:nosplit
+//go:nowritebarrierec
+func (b *Buffered_UART) isr(irqnum uint32) {
+	regs := b.uart.regs
+	received := false
+	for regs.usr2&UART_USR2_RDR != 0 {
+		received = true
+		c := regs.urxd
+		if c&UART_URXD_ERR != 0 {
+			atomic.AddUint32(&b.rx_errors, 1)
+		}
+		if !b.rx.put(byte(c & READ_MASK)) {
+			atomic.AddUint32(&b.rx_dropped, 1)
+		}
+	}
+	regs.usr1 = UART_USR1_AGTIM
+	//only once the bytes are in the ring, or a Read could look too early and then never hear about them
+	if received {
+		b.rx_wake.Signal()
+	}
+
+	if regs.ucr1&UART_UCR1_TRDYEN == 0 {
+		return
+	}
+	for regs.uts&UART_UTS_TXFULL == 0 {
+		c, ok := b.tx.get()
+		if !ok {
+			regs.ucr1 &^= UART_UCR1_TRDYEN
+			runtime.DMB()
+			if b.tx.len() != 0 {
+				regs.ucr1 |= UART_UCR1_TRDYEN
+			}
+			break
+		}
+		regs.utxd = uint32(c)
+	}
+	//there is room in the ring now, or it is empty for Flush
+	b.tx_wake.Signal()
+}
+
+//Blocks until at least one byte has arrived and then returns as many as fit in p
+func (b *Buffered_UART) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	b.rlock.Lock()
+	defer b.rlock.Unlock()
+	for b.rx.len() == 0 {
+		b.rx_wake.Wait()
+	}
+	n := 0
+	for n < len(p) {
+		c, ok := b.rx.get()
+		if !ok {
+			break
+		}
+		p[n] = c
+		n++
+	}
+	return n, nil
+}
+
+//Blocks until all of p is in the TX ring. It goes out in the background.
+func (b *Buffered_UART) Write(p []byte) (int, error) {
+	b.wlock.Lock()
+	defer b.wlock.Unlock()
+	for i := 0; i < len(p); {
+		if b.tx.put(p[i]) {
+			i++
+			continue
+		}
+		//full, so let the ISR drain some
+		b.uart.regs.ucr1 |= UART_UCR1_TRDYEN
+		b.tx_wake.Wait()
+	}
+	b.uart.regs.ucr1 |= UART_UCR1_TRDYEN
+	return len(p), nil
+}
+
+//Blocks until everything written so far has left the uart
+func (b *Buffered_UART) Flush() {
+	b.wlock.Lock()
+	for b.tx.len() != 0 {
+		b.tx_wake.Wait()
+	}
+	b.uart.Flush()
+	b.wlock.Unlock()
+}
+
+//how many bytes are waiting to be read
+func (b *Buffered_UART) Buffered() int {
+	return int(b.rx.len())
+}
+
+//how many received bytes were thrown away because nobody read the ring in time
+func (b *Buffered_UART) Dropped() uint32 {
+	return atomic.LoadUint32(&b.rx_dropped)
+}
+
+//how many received bytes had a parity, framing, break or overrun error
+func (b *Buffered_UART) Errors() uint32 {
+	return atomic.LoadUint32(&b.rx_errors)
+}
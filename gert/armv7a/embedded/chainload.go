@@ -0,0 +1,423 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package embedded
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+/*
+* Loads a new bootloader.elf over a serial port so you dont have to walk the sdcard to the board.
+* The image comes in with YMODEM or XMODEM-1K (CRC16), whichever the sender speaks.
+* tools/gertload is the sender that goes with this.
+*
+* There are two ways to run it:
+* reset: copy the elf to CHAINLOAD_STAGING, mark it, and reset the board. uboot_bin/uEnv.txt
+*        boots a marked image instead of the sdcard once and clears the mark. The mark has the
+*        length and crc32 of the image, and u-boot falls back to the sdcard if they dont match.
+*        This is the safe one.
+* jump:  stop the other cpus, load the elf the way u-boot's bootelf does, turn off the caches and
+*        the MMU and jump to it. It assumes the runtime identity maps the bootloader's addresses.
+ */
+
+const (
+	CHAINLOAD_STAGING = 0x7E000000
+	CHAINLOAD_MARK    = 0x7DFFF000
+	CHAINLOAD_MAGIC   = 0x4C524547 //"GERL"
+	//the bootloader uses the 1MB at 0x7FD00000
+	CHAINLOAD_MAX = 0x7FD00000 - CHAINLOAD_STAGING
+
+	//On 32bit the runtime reserves its spans, the heap bitmap and a 512MB arena in one piece
+	//a little past the end of the program (mallocinit), and the heap stays in there until it outgrows the arena
+	CHAINLOAD_ARENA        = 512 << 20
+	CHAINLOAD_HEAP_RESERVE = CHAINLOAD_ARENA/8192*4 + CHAINLOAD_ARENA/16 + CHAINLOAD_ARENA + 8192
+
+	XMODEM_SOH = 0x01
+	XMODEM_STX = 0x02
+	XMODEM_EOT = 0x04
+	XMODEM_ACK = 0x06
+	XMODEM_NAK = 0x15
+	XMODEM_CAN = 0x18
+	XMODEM_C   = 'C'
+
+	XMODEM_RETRIES = 10
+	XMODEM_TIMEOUT = time.Second
+)
+
+//src.SCR turns the other cores on and off
+var src_scr = (*uint32)(unsafe.Pointer(uintptr(0x20D8000)))
+
+//CRC16-CCITT with a 0 seed, which is what XMODEM calls CRC
+func xmodem_crc(data []byte) uint16 {
+	crc := uint16(0)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = (crc << 1) ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func chainload_getc(port *Buffered_UART, timeout time.Duration) (byte, bool) {
+	deadline := Nanotime() + int64(timeout)
+	for port.Buffered() == 0 {
+		if Nanotime() > deadline {
+			return 0, false
+		}
+		runtime.Gosched()
+	}
+	var c [1]byte
+	port.Read(c[:])
+	return c[0], true
+}
+
+func chainload_putc(port *Buffered_UART, c byte) {
+	port.Write([]byte{c})
+}
+
+//throws away whatever the sender is in the middle of so it can retry cleanly
+func chainload_purge(port *Buffered_UART) {
+	for {
+		if _, ok := chainload_getc(port, XMODEM_TIMEOUT/4); !ok {
+			return
+		}
+	}
+}
+
+func chainload_cancel(port *Buffered_UART) {
+	port.Write([]byte{XMODEM_CAN, XMODEM_CAN, XMODEM_CAN})
+	port.Flush()
+}
+
+//Reads the rest of a block after its SOH or STX. Returns the block number and the data,
+//or ok false if it timed out or the CRC was bad.
+func chainload_block(port *Buffered_UART, size int, buf []byte) (uint8, []byte, bool) {
+	n := size + 4
+	for i := 0; i < n; i++ {
+		c, ok := chainload_getc(port, XMODEM_TIMEOUT)
+		if !ok {
+			return 0, nil, false
+		}
+		buf[i] = c
+	}
+	if buf[0] != ^buf[1] {
+		return 0, nil, false
+	}
+	data := buf[2 : 2+size]
+	crc := uint16(buf[2+size])<<8 | uint16(buf[3+size])
+	if crc != xmodem_crc(data) {
+		return 0, nil, false
+	}
+	return buf[0], data, true
+}
+
+//Receives one file with YMODEM or XMODEM-1K, asking for it with 'C' for up to a minute.
+//Returns the file and its name, which is empty for XMODEM. XMODEM cant say how long
+//the file is, so it comes back padded out to a whole block.
+func Chainload_receive(port *Buffered_UART) ([]byte, string, error) {
+	Clock_init()
+	buf := make([]byte, 1024+4)
+	var image []byte
+	name := ""
+	size := -1
+	expect := uint8(0)
+	ymodem := false
+	errors_left := XMODEM_RETRIES
+	eots := 0
+
+	//keep asking until a block starts, ignoring whatever else is on the line
+	var c byte
+	started := false
+	for tries := 0; !started && tries < 60; tries++ {
+		chainload_putc(port, XMODEM_C)
+		deadline := Nanotime() + int64(XMODEM_TIMEOUT)
+		for !started && Nanotime() < deadline {
+			var ok bool
+			if c, ok = chainload_getc(port, XMODEM_TIMEOUT); ok {
+				started = c == XMODEM_SOH || c == XMODEM_STX || c == XMODEM_CAN
+			}
+		}
+	}
+	if !started {
+		return nil, "", errors.New("nobody sent anything")
+	}
+
+	for {
+		blocksize := 0
+		switch c {
+		case XMODEM_SOH:
+			blocksize = 128
+		case XMODEM_STX:
+			blocksize = 1024
+		case XMODEM_EOT:
+			//YMODEM senders want the first EOT NAKed to be sure it wasnt noise
+			eots++
+			if ymodem && eots == 1 {
+				chainload_putc(port, XMODEM_NAK)
+				break
+			}
+			chainload_putc(port, XMODEM_ACK)
+			if ymodem {
+				//the sender closes the batch with an empty block 0
+				chainload_putc(port, XMODEM_C)
+				if c, ok := chainload_getc(port, XMODEM_TIMEOUT); ok && (c == XMODEM_SOH || c == XMODEM_STX) {
+					bs := 128
+					if c == XMODEM_STX {
+						bs = 1024
+					}
+					chainload_block(port, bs, buf)
+					chainload_putc(port, XMODEM_ACK)
+				}
+				if size >= 0 && size < len(image) {
+					image = image[:size]
+				}
+			}
+			port.Flush()
+			return image, name, nil
+		case XMODEM_CAN:
+			return nil, "", errors.New("sender cancelled")
+		default:
+			chainload_purge(port)
+			chainload_putc(port, XMODEM_NAK)
+			errors_left--
+		}
+
+		if blocksize != 0 {
+			num, data, ok := chainload_block(port, blocksize, buf)
+			switch {
+			case !ok:
+				chainload_purge(port)
+				chainload_putc(port, XMODEM_NAK)
+				errors_left--
+			case num == 0 && expect == 0 && len(image) == 0 && !ymodem:
+				//YMODEM header: name, NUL, then the size in decimal
+				ymodem = true
+				fields := bytes.SplitN(data, []byte{0}, 2)
+				name = string(fields[0])
+				if len(fields) == 2 {
+					info := strings.Fields(string(bytes.TrimRight(fields[1], "\x00")))
+					if len(info) > 0 {
+						if n, err := strconv.Atoi(info[0]); err == nil {
+							size = n
+						}
+					}
+				}
+				if size > CHAINLOAD_MAX {
+					chainload_cancel(port)
+					return nil, "", errors.New("image too big")
+				}
+				expect = 1
+				chainload_putc(port, XMODEM_ACK)
+				chainload_putc(port, XMODEM_C)
+			case num == expect || (expect == 0 && num == 1 && !ymodem):
+				//XMODEM starts at block 1
+				if len(image)+len(data) > CHAINLOAD_MAX {
+					chainload_cancel(port)
+					return nil, "", errors.New("image too big")
+				}
+				image = append(image, data...)
+				expect = num + 1
+				errors_left = XMODEM_RETRIES
+				chainload_putc(port, XMODEM_ACK)
+			case num == expect-1:
+				//our ACK got lost and the sender repeated the block
+				chainload_putc(port, XMODEM_ACK)
+			default:
+				chainload_cancel(port)
+				return nil, "", errors.New("blocks out of sequence")
+			}
+		}
+		if errors_left == 0 {
+			chainload_cancel(port)
+			return nil, "", errors.New("too many errors")
+		}
+
+		var ok bool
+		if c, ok = chainload_getc(port, 10*XMODEM_TIMEOUT); !ok {
+			chainload_cancel(port)
+			return nil, "", errors.New("sender went quiet")
+		}
+	}
+}
+
+//Makes sure image is a 32bit ARM elf whose loadable segments are all inside it and returns its entry point
+func Chainload_check(image []byte) (uint32, error) {
+	f, err := elf.NewFile(bytes.NewReader(image))
+	if err != nil {
+		return 0, err
+	}
+	if f.Class != elf.ELFCLASS32 || f.Machine != elf.EM_ARM {
+		return 0, errors.New("not a 32bit ARM elf")
+	}
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD {
+			continue
+		}
+		if p.Off+p.Filesz > uint64(len(image)) || p.Filesz > p.Memsz {
+			return 0, errors.New("segment runs past the end of the image")
+		}
+	}
+	return uint32(f.Entry), nil
+}
+
+func chainload_overlaps(a, alen, b, blen uintptr) bool {
+	return a < b+blen && b < a+alen
+}
+
+//everywhere the heap could be, from the end of the program to the end of the runtime's reservation
+func chainload_heap() (uintptr, uintptr, error) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	if m.HeapSys > CHAINLOAD_ARENA {
+		return 0, 0, errors.New("the heap outgrew its arena, cant tell where it is")
+	}
+	_, end := chainload_image()
+	reserve := (uintptr(end) + 1<<18 + 1<<20 - 1) &^ (1<<20 - 1)
+	return uintptr(end), reserve + CHAINLOAD_HEAP_RESERVE, nil
+}
+
+//the image, the stack we are on, the heap, and the code doing the copy all have to survive it
+func chainload_check_dest(image []byte, dest, size uintptr) error {
+	var local uint32
+	stack := uintptr(unsafe.Pointer(&local))
+	if chainload_overlaps(dest, size, uintptr(unsafe.Pointer(&image[0])), uintptr(len(image))) {
+		return errors.New("image buffer is in the way of the load address")
+	}
+	if chainload_overlaps(dest, size, stack-0x4000, 0x8000) {
+		return errors.New("stack is in the way of the load address")
+	}
+	start, end := chainload_image()
+	if chainload_overlaps(dest, size, uintptr(start), uintptr(end-start)) {
+		return errors.New("this program is in the way of the load address")
+	}
+	heap, heap_end, err := chainload_heap()
+	if err != nil {
+		return err
+	}
+	if chainload_overlaps(dest, size, heap, heap_end-heap) {
+		return errors.New("the heap is in the way of the load address")
+	}
+	return nil
+}
+
+//Copies image to where uEnv.txt looks for it and resets the board with WDOG1.
+//A reset doesnt write back the caches, so the image and the mark get cleaned out to memory first.
+func Chainload_reset(image []byte) error {
+	if _, err := Chainload_check(image); err != nil {
+		return err
+	}
+	if len(image) > CHAINLOAD_MAX {
+		return errors.New("image too big")
+	}
+	if err := chainload_check_dest(image, CHAINLOAD_MARK, CHAINLOAD_STAGING+uintptr(len(image))-CHAINLOAD_MARK); err != nil {
+		return err
+	}
+	fmt.Printf("chainload: %d bytes, crc32 0x%08x, resetting\r\n", len(image), crc32.ChecksumIEEE(image))
+	runtime.DisableIRQ()
+	staging := (*[CHAINLOAD_MAX]byte)(unsafe.Pointer(uintptr(CHAINLOAD_STAGING)))
+	copy(staging[:], image)
+	Dma_clean(staging[:len(image)])
+	//the last word is where u-boot puts the crc it works out
+	mark := (*[4]uint32)(unsafe.Pointer(uintptr(CHAINLOAD_MARK)))
+	mark[1] = uint32(len(image))
+	mark[2] = crc32.ChecksumIEEE(image)
+	mark[3] = 0
+	mark[0] = CHAINLOAD_MAGIC
+	Dma_clean((*[16]byte)(unsafe.Pointer(mark))[:])
+	WDOG1.Reset()
+	for {
+	}
+}
+
+//Loads image like bootelf and jumps to it on cpu0 with the other cpus held in reset.
+//Only returns if the image is bad or something is in the way of it.
+func Chainload_jump(image []byte) error {
+	entry, err := Chainload_check(image)
+	if err != nil {
+		return err
+	}
+	f, _ := elf.NewFile(bytes.NewReader(image))
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD {
+			continue
+		}
+		if err := chainload_check_dest(image, uintptr(p.Paddr), uintptr(p.Memsz)); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("chainload: %d bytes, crc32 0x%08x, jumping to 0x%x\r\n", len(image), crc32.ChecksumIEEE(image), entry)
+
+	//get onto cpu0 and stay there
+	for {
+		runtime.DisableIRQ()
+		if runtime.Cpunum() == 0 {
+			break
+		}
+		runtime.EnableIRQ()
+		runtime.Gosched()
+	}
+	*src_scr &^= 0x7 << 22
+	gic_distributor.distributor_control_register = 0
+	gic_cpu.cpu_interface_control_register = 0
+
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD {
+			continue
+		}
+		dest := (*[1 << 30]byte)(unsafe.Pointer(uintptr(p.Paddr)))[:p.Memsz:p.Memsz]
+		n := copy(dest, image[p.Off:p.Off+p.Filesz])
+		for i := n; i < len(dest); i++ {
+			dest[i] = 0
+		}
+	}
+	chainload_boot(entry)
+	return nil
+}
+
+//the text, data and bss of the running program
+func chainload_image() (start, end uint32)
+
+//cleans the caches, turns them and the MMU off, and branches to entry. Never returns.
+func chainload_boot(entry uint32)
+
+//A shell command that receives an image on port and then boots it with "load reset" or "load jump"
+func Chainload_command(port *Buffered_UART) Shell_func {
+	return func(sh *Shell, args []string) error {
+		jump := false
+		if len(args) > 1 {
+			switch args[1] {
+			case "jump":
+				jump = true
+			case "reset":
+			default:
+				return errors.New("load [reset|jump]")
+			}
+		}
+		fmt.Fprintf(sh, "waiting for YMODEM or XMODEM-1K...\n")
+		image, name, err := Chainload_receive(port)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(sh, "got %s, %d bytes\n", name, len(image))
+		if jump {
+			return Chainload_jump(image)
+		}
+		return Chainload_reset(image)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+#include "textflag.h"
+
+// func chainload_boot(entry uint32)
+// IRQs are already off and the other cpus are in reset. Nothing here touches memory
+// after the D-cache is off, so the stack doesnt matter anymore.
+TEXT ·chainload_boot(SB), NOSPLIT, $0-4
+	MOVW entry+0(FP), R4
+	WORD $0xf10c01c0     // cpsid aif
+
+	// turn off the L1 D-cache
+	WORD $0xee110f10     // mrc p15, 0, r0, c1, c0, 0 (SCTLR)
+	BIC  $0x4, R0
+	WORD $0xee010f10     // mcr p15, 0, r0, c1, c0, 0
+	WORD $0xf57ff04f     // dsb
+
+	// clean and invalidate it by set/way: 4 ways in bits 31:30, 256 sets in bits 12:5
+	MOVW $0, R1
+l1_way:
+	MOVW $0, R2
+l1_set:
+	MOVW R1<<30, R0
+	ORR  R2<<5, R0
+	WORD $0xee070f5e     // mcr p15, 0, r0, c7, c14, 2 (DCCISW)
+	ADD  $1, R2
+	CMP  $256, R2
+	BNE  l1_set
+	ADD  $1, R1
+	CMP  $4, R1
+	BNE  l1_way
+	WORD $0xf57ff04f     // dsb
+
+	// clean and invalidate all 16 ways of the PL310 L2, then turn it off
+	MOVW $0x00A02000, R5
+	MOVW $0xFFFF, R0
+	MOVW R0, 0x7FC(R5)
+l2_wait:
+	MOVW 0x7FC(R5), R0
+	CMP  $0, R0
+	BNE  l2_wait
+	MOVW $0, R0
+	MOVW R0, 0x730(R5)   // cache sync
+	MOVW R0, 0x100(R5)   // disable
+	WORD $0xf57ff04f     // dsb
+
+	// MMU, I-cache, branch prediction and alignment checks off
+	WORD $0xee110f10     // mrc p15, 0, r0, c1, c0, 0
+	BIC  $0x7, R0
+	BIC  $0x1800, R0
+	WORD $0xee010f10     // mcr p15, 0, r0, c1, c0, 0
+	MOVW $0, R0
+	WORD $0xee070f15     // mcr p15, 0, r0, c7, c5, 0 (ICIALLU)
+	WORD $0xee070fd5     // mcr p15, 0, r0, c7, c5, 6 (BPIALL)
+	WORD $0xee080f17     // mcr p15, 0, r0, c8, c7, 0 (TLBIALL)
+	WORD $0xf57ff04f     // dsb
+	WORD $0xf57ff06f     // isb
+	B    (R4)
+
+// func chainload_image() (start, end uint32)
+// the running program from the start of its text to the end of its bss, as the linker laid it out
+TEXT ·chainload_image(SB), NOSPLIT, $0-8
+	MOVW $runtime·text(SB), R0
+	MOVW R0, start+0(FP)
+	MOVW $runtime·end(SB), R0
+	MOVW R0, end+4(FP)
+	RET
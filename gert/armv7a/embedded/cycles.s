@@ -0,0 +1,21 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+#include "textflag.h"
+
+// func Cycle_counter_init()
+TEXT ·Cycle_counter_init(SB), NOSPLIT, $0-0
+	WORD $0xee190f1c     // mrc p15, 0, r0, c9, c12, 0 (PMCR)
+	ORR  $0x5, R0        // E: enable the counters, C: reset the cycle counter
+	BIC  $0x8, R0        // D: count every cycle instead of every 64th
+	WORD $0xee090f1c     // mcr p15, 0, r0, c9, c12, 0
+	MOVW $0x80000000, R0
+	WORD $0xee090f3c     // mcr p15, 0, r0, c9, c12, 1 (PMCNTENSET)
+	RET
+
+// func Cycles() uint32
+TEXT ·Cycles(SB), NOSPLIT, $0-4
+	WORD $0xee190f1d     // mrc p15, 0, r0, c9, c13, 0 (PMCCNTR)
+	MOVW R0, ret+0(FP)
+	RET
@@ -0,0 +1,147 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package embedded
+
+import "unsafe"
+import "errors"
+import "time"
+
+/*
+* Enhanced Periodic Interrupt Timers.
+* Each EPIT counts down from its load register, interrupts when it hits the compare register
+* and reloads, so you get a periodic interrupt without touching the GPT.
+* Section 24 of the iMX6 Quad Applications Manual
+ */
+
+//clock sources, same encoding as the PWM
+const (
+	EPIT_CLK_IPG          = clk_ipg
+	EPIT_CLK_IPG_HIGHFREQ = clk_ipg_highfreq
+	EPIT_CLK_32K          = clk_ipg_32k
+
+	IPG_CLK_HZ          = 66000000
+	IPG_CLK_HIGHFREQ_HZ = 66000000
+	IPG_CLK_32K_HZ      = 32768
+)
+
+const (
+	EPIT_CR_EN     = 1 << 0
+	EPIT_CR_ENMOD  = 1 << 1
+	EPIT_CR_OCIEN  = 1 << 2
+	EPIT_CR_RLD    = 1 << 3
+	EPIT_CR_SWR    = 1 << 16
+	EPIT_CR_IOVW   = 1 << 17
+	EPIT_CR_DBGEN  = 1 << 18
+	EPIT_CR_WAITEN = 1 << 19
+	EPIT_CR_STOPEN = 1 << 21
+	EPIT_SR_OCIF   = 1 << 0
+)
+
+type EPIT_regs struct {
+	CR   uint32
+	SR   uint32
+	LR   uint32
+	CMPR uint32
+	CNR  uint32
+}
+
+type EPIT_periph struct {
+	regs   *EPIT_regs
+	irq    uint32
+	hz     uint32
+	period time.Duration
+}
+
+var EPIT1 = &EPIT_periph{(*EPIT_regs)(unsafe.Pointer(uintptr(0x20D0000))), 88, 0, 0}
+var EPIT2 = &EPIT_periph{(*EPIT_regs)(unsafe.Pointer(uintptr(0x20D4000))), 89, 0, 0}
+
+func epit_clock_hz(clock uint32) uint32 {
+	switch clock {
+	case EPIT_CLK_IPG:
+		return IPG_CLK_HZ
+	case EPIT_CLK_IPG_HIGHFREQ:
+		return IPG_CLK_HIGHFREQ_HZ
+	case EPIT_CLK_32K:
+		return IPG_CLK_32K_HZ
+	}
+	return 0
+}
+
+//Resets the timer and sets it up to fire every period from the given clock source.
+//The timer doesnt run until Start.
+func (epit *EPIT_periph) Begin(clock uint32, period time.Duration) error {
+	hz := epit_clock_hz(clock)
+	if hz == 0 {
+		return errors.New("bad EPIT clock source")
+	}
+	if period <= 0 {
+		return errors.New("EPIT period must be positive")
+	}
+	//split it up so long periods dont overflow
+	ticks := (uint64(period)/1000000000)*uint64(hz) + ((uint64(period)%1000000000)*uint64(hz)+500000000)/1000000000
+	if ticks == 0 {
+		return errors.New("EPIT period is shorter than one clock")
+	}
+	//the 12bit prescaler stretches the 32bit load register
+	prescale := (ticks + 0xFFFFFFFF) / 0x100000000
+	if prescale > 4096 {
+		return errors.New("EPIT period too long for this clock")
+	}
+	load := ticks/prescale - 1
+
+	epit.regs.CR = 0
+	epit.regs.CR = EPIT_CR_SWR
+	for epit.regs.CR&EPIT_CR_SWR != 0 {
+	}
+	epit.regs.CR = (clock << 24) | (uint32(prescale-1) << 4) | EPIT_CR_RLD | EPIT_CR_ENMOD | EPIT_CR_IOVW | EPIT_CR_WAITEN | EPIT_CR_STOPEN | EPIT_CR_DBGEN
+	epit.regs.LR = uint32(load)
+	epit.regs.CMPR = 0
+	epit.regs.SR = EPIT_SR_OCIF
+
+	epit.hz = hz / uint32(prescale)
+	epit.period = time.Duration((load+1)/uint64(epit.hz))*time.Second + time.Duration((((load+1)%uint64(epit.hz))*1000000000)/uint64(epit.hz))
+	return nil
+}
+
+//the period after rounding to whole clock ticks
+func (epit *EPIT_periph) Period() time.Duration {
+	return epit.period
+}
+
+func (epit *EPIT_periph) Start() {
+	epit.regs.SR = EPIT_SR_OCIF
+	epit.regs.CR |= EPIT_CR_EN
+}
+
+func (epit *EPIT_periph) Stop() {
+	epit.regs.CR &= ^uint32(EPIT_CR_EN)
+}
+
+//how many ticks are left in this period
+//go:nosplit
+func (epit *EPIT_periph) Count() uint32 {
+	return epit.regs.CNR
+}
+
+//Runs handler on cpunum at the end of every period. The status flag is cleared for you.
+//The handler runs in IRQ mode so it must be nosplit and must not block or allocate.
+func (epit *EPIT_periph) EnableIntr(cpunum uint32, priority uint8, handler Interrupt_handler) {
+	Register_interrupt(epit.irq, cpunum, priority, handler, epit.ClearIntr)
+	epit.regs.CR |= EPIT_CR_OCIEN
+}
+
+func (epit *EPIT_periph) DisableIntr() {
+	epit.regs.CR &= ^uint32(EPIT_CR_OCIEN)
+	Unregister_interrupt(epit.irq)
+}
+
+//go:nosplit
+func (epit *EPIT_periph) ClearIntr() {
+	epit.regs.SR = EPIT_SR_OCIF
+}
+
+func (epit *EPIT_periph) GetIRQnum() uint32 {
+	return epit.irq
+}
@@ -0,0 +1,1081 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package embedded
+
+import (
+	"errors"
+	"runtime"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+/*
+* A GDB remote serial protocol stub, so arm-none-eabi-gdb can debug the board over a serial cable:
+*
+*	(gdb) target remote /dev/ttyUSB1
+*
+* It takes over the undefined instruction vector. Breakpoints are the undefined instruction gdb
+* already uses (0xe7ffdefe), so hitting one, calling Gdb_break, or running any other undefined
+* instruction halts that cpu in gdb_und_vector with its registers saved in a gdb_frame.
+* The server is a goroutine, so it keeps running on whichever cpu it is on while the others are halted.
+* To halt the rest it sends them GDB_SGI, whose handler calls Gdb_break. A cpu halted that way
+* shows up in gdb inside the IRQ handler it was running.
+* Each halted cpu is a thread in gdb, thread n is cpu n-1.
+*
+* A halted cpu can be holding the heap lock, and a GC would wait forever for it to stop,
+* so from halt_others until everything runs again the server never allocates or yields.
+* Packets are built in fixed buffers and the uart gets polled, since its ISR might be on a halted cpu.
+*
+* Single step puts temporary breakpoints on every instruction that can run next, so it only works on ARM
+* (not thumb) code and gives up on the few instructions whose next pc it cant work out.
+* Everything here assumes the runtime identity maps memory and lets us write to its text.
+* Reading an address with nothing behind it takes a data abort, and a breakpoint in the
+* runtime or the scheduler can wedge the cpu running this server, so keep breakpoints in user code.
+ */
+
+const (
+	GDB_SGI          = 2
+	GDB_SGI_PRIORITY = 0x00
+	GDB_BREAKPOINT   = 0xe7ffdefe
+	//what gdb for arm linux uses, in case someone has that one
+	GDB_BREAKPOINT_LINUX = 0xe7f001f0
+
+	GDB_SIGINT  = 2
+	GDB_SIGILL  = 4
+	GDB_SIGTRAP = 5
+
+	//what we tell gdb in qSupported, in hex there
+	GDB_PACKET_SIZE     = 0x1000
+	GDB_MAX_BREAKPOINTS = 64
+)
+
+//gdb.s knows this layout
+type gdb_frame struct {
+	r      [16]uint32
+	cpsr   uint32
+	halted uint32
+	_      [14]uint32
+}
+
+var gdb_frames [MAX_CPUS]gdb_frame
+var gdb_installed uint32
+var gdb_installing uint32
+var gdb_installed_cpus uint32
+var gdb_halting uint32
+
+type gdb_breakpoint struct {
+	addr uint32
+	orig uint32
+	used bool
+}
+
+type gdb_server struct {
+	port        *Buffered_UART
+	polled      bool
+	stopped     bool
+	interrupted bool
+	cur         int
+	stepping    int
+	breakpoints [GDB_MAX_BREAKPOINTS]gdb_breakpoint
+	temp        [2]gdb_breakpoint
+	signal      [MAX_CPUS]int
+	in          [GDB_PACKET_SIZE]byte
+	out         [GDB_PACKET_SIZE]byte
+	outlen      int
+	ack         [1]byte
+}
+
+//made up front, errors.New allocates
+var (
+	gdb_err_bad    = errors.New("gdb: bad packet")
+	gdb_err_thumb  = errors.New("gdb: cant step thumb code")
+	gdb_err_shift  = errors.New("gdb: cant step a register shifted register")
+	gdb_err_rrx    = errors.New("gdb: cant step an rrx")
+	gdb_err_vector = errors.New("gdb: the vector table is too far from the handler to branch to it")
+)
+
+func gdb_und_vector()
+func gdb_und_vector_addr() uint32
+func gdb_vbar() uint32
+func gdb_set_und_stack(frame uint32)
+func gdb_sync_icache(addr uint32)
+
+//Halts the calling cpu and hands it to gdb, like a breakpoint compiled into the program.
+//Without Gdb_begin it is just an undefined instruction.
+func Gdb_break()
+
+//every cpu gets the SGI once at startup to point its SP_und at its frame, and after that only to halt it
+//go:nosplit
+//go:nowritebarrierec
+func gdb_sgi_isr(irqnum uint32) {
+	if atomic.LoadUint32(&gdb_installing) != 0 {
+		cpu := uint32(runtime.Cpunum()) & (MAX_CPUS - 1)
+		gdb_set_und_stack(uint32(uintptr(unsafe.Pointer(&gdb_frames[cpu]))))
+		atomic.AddUint32(&gdb_installed_cpus, 1)
+		return
+	}
+	if atomic.LoadUint32(&gdb_halting) != 0 {
+		Gdb_break()
+	}
+}
+
+//Points the undefined instruction vector at gdb_und_vector. The vector is either a branch,
+//which gets replaced, or a load of pc from a literal, which gets its literal replaced.
+func gdb_hook_vector() error {
+	slot := gdb_vbar() + 4
+	handler := gdb_und_vector_addr()
+	insn := gdb_read32(slot)
+	if insn&0xFFFFF000 == 0xE59FF000 {
+		//ldr pc, [pc, #imm]
+		literal := slot + 8 + (insn & 0xFFF)
+		gdb_write32(literal, handler)
+		return nil
+	}
+	offset := int32(handler-(slot+8)) >> 2
+	if offset >= 1<<23 || offset < -(1<<23) {
+		return gdb_err_vector
+	}
+	gdb_write32(slot, 0xEA000000|(uint32(offset)&0xFFFFFF))
+	return nil
+}
+
+//Takes over the undefined instruction vector and starts serving gdb on port.
+//Use a uart that nothing else prints on, the console gets runtime prints in the middle of packets.
+func Gdb_begin(port *Buffered_UART) error {
+	if !atomic.CompareAndSwapUint32(&gdb_installed, 0, 1) {
+		return errors.New("gdb: already running")
+	}
+	Clock_init()
+	Register_interrupt(GDB_SGI, 0, GDB_SGI_PRIORITY, gdb_sgi_isr, nil)
+	atomic.StoreUint32(&gdb_installed_cpus, 0)
+	atomic.StoreUint32(&gdb_installing, 1)
+	Sgi(GDB_SGI, gdb_cpus())
+	deadline := Nanotime() + int64(100*time.Millisecond)
+	for atomic.LoadUint32(&gdb_installed_cpus) < uint32(runtime.GOMAXPROCS(0)) && Nanotime() < deadline {
+		runtime.Gosched()
+	}
+	atomic.StoreUint32(&gdb_installing, 0)
+	if atomic.LoadUint32(&gdb_installed_cpus) < uint32(runtime.GOMAXPROCS(0)) {
+		gdb_uninstall()
+		return errors.New("gdb: not every cpu answered the SGI")
+	}
+	if err := gdb_hook_vector(); err != nil {
+		gdb_uninstall()
+		return err
+	}
+	g := &gdb_server{port: port, stepping: -1}
+	go g.run()
+	return nil
+}
+
+//so a Gdb_begin that failed can be tried again
+func gdb_uninstall() {
+	Unregister_interrupt(GDB_SGI)
+	atomic.StoreUint32(&gdb_installed, 0)
+}
+
+//the cpus the runtime runs on
+func gdb_cpus() uint32 {
+	mask := uint32(0)
+	for cpu := 0; cpu < runtime.GOMAXPROCS(0) && cpu < MAX_CPUS; cpu++ {
+		mask |= 1 << uint32(cpu)
+	}
+	return mask
+}
+
+//go:nosplit
+func gdb_read32(addr uint32) uint32 {
+	return *(*uint32)(unsafe.Pointer(uintptr(addr)))
+}
+
+func gdb_write32(addr, val uint32) {
+	*(*uint32)(unsafe.Pointer(uintptr(addr))) = val
+	gdb_sync_icache(addr)
+}
+
+func gdb_halted(cpu int) bool {
+	return atomic.LoadUint32(&gdb_frames[cpu].halted) != 0
+}
+
+func gdb_any_halted() bool {
+	for cpu := 0; cpu < MAX_CPUS; cpu++ {
+		if gdb_halted(cpu) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+* Breakpoints live in fixed tables so setting one doesnt allocate
+ */
+
+func gdb_find(table []gdb_breakpoint, addr uint32) *gdb_breakpoint {
+	for i := range table {
+		if table[i].used && table[i].addr == addr {
+			return &table[i]
+		}
+	}
+	return nil
+}
+
+//patches addr with a breakpoint and remembers what was there. False if the table is full.
+func gdb_insert(table []gdb_breakpoint, addr uint32) bool {
+	for i := range table {
+		if !table[i].used {
+			table[i] = gdb_breakpoint{addr, gdb_read32(addr), true}
+			gdb_write32(addr, GDB_BREAKPOINT)
+			return true
+		}
+	}
+	return false
+}
+
+func gdb_remove(b *gdb_breakpoint) {
+	gdb_write32(b.addr, b.orig)
+	b.used = false
+}
+
+func gdb_remove_all(table []gdb_breakpoint) {
+	for i := range table {
+		if table[i].used {
+			gdb_remove(&table[i])
+		}
+	}
+}
+
+/*
+* Running and stopping cpus
+ */
+
+//Turns off the Buffered_UART's interrupts so we can poll the uart ourselves.
+//Its ISR might be routed to a cpu that is about to halt, and then nothing would move the bytes.
+func (g *gdb_server) take_port() {
+	if g.polled {
+		return
+	}
+	u := g.port.uart
+	u.regs.ucr1 &^= UART_UCR1_RRDYEN | UART_UCR1_TRDYEN
+	u.regs.ucr2 &^= UART_UCR2_ATEN
+	runtime.DMB()
+	//let an ISR that already started finish, unless its cpu is stuck in it
+	deadline := Nanotime() + int64(10*time.Millisecond)
+	for Interrupt_active(u.irq) && Nanotime() < deadline {
+	}
+	//whatever it hadnt sent yet goes out first
+	for {
+		c, ok := g.port.tx.get()
+		if !ok {
+			break
+		}
+		u.putchar(c)
+	}
+	g.polled = true
+}
+
+//hands the uart back to its ISR once nothing is halted
+func (g *gdb_server) give_port() {
+	if !g.polled {
+		return
+	}
+	g.polled = false
+	u := g.port.uart
+	u.regs.ucr2 |= UART_UCR2_ATEN
+	u.regs.ucr1 |= UART_UCR1_RRDYEN
+}
+
+//Sends GDB_SGI to every cpu but ours and waits a bit for them to halt.
+//IRQs are off while we look at which cpu we are on, so we cant move in the middle.
+func (g *gdb_server) halt_others() {
+	atomic.StoreUint32(&gdb_halting, 1)
+	runtime.DisableIRQ()
+	self := uint32(runtime.Cpunum())
+	targets := gdb_cpus() &^ (1 << self)
+	for cpu := 0; cpu < MAX_CPUS; cpu++ {
+		if gdb_halted(cpu) {
+			targets &^= 1 << uint32(cpu)
+		}
+	}
+	Sgi(GDB_SGI, targets)
+	runtime.EnableIRQ()
+	//no Gosched from here on, see the top of the file
+	deadline := Nanotime() + int64(100*time.Millisecond)
+	for Nanotime() < deadline {
+		done := true
+		for cpu := uint32(0); cpu < MAX_CPUS; cpu++ {
+			if targets&(1<<cpu) != 0 && !gdb_halted(int(cpu)) {
+				done = false
+			}
+		}
+		if done {
+			break
+		}
+	}
+	//a cpu that was already halted takes the SGI when it resumes, and should ignore it then
+	atomic.StoreUint32(&gdb_halting, 0)
+}
+
+//Works out why cpu halted. A breakpoint we didnt put there was compiled in, so step over it.
+func (g *gdb_server) classify(cpu int) {
+	f := &gdb_frames[cpu]
+	pc := f.r[15]
+	insn := gdb_read32(pc)
+	ours := gdb_find(g.breakpoints[:], pc) != nil || gdb_find(g.temp[:], pc) != nil
+	switch {
+	case insn == GDB_BREAKPOINT || insn == GDB_BREAKPOINT_LINUX:
+		if !ours {
+			f.r[15] = pc + 4
+		}
+		g.signal[cpu] = GDB_SIGTRAP
+	default:
+		g.signal[cpu] = GDB_SIGILL
+	}
+	if g.interrupted {
+		g.signal[cpu] = GDB_SIGINT
+	}
+}
+
+func (g *gdb_server) resume(cpu int) {
+	runtime.DMB()
+	atomic.StoreUint32(&gdb_frames[cpu].halted, 0)
+}
+
+func (g *gdb_server) resume_all() {
+	for cpu := 0; cpu < MAX_CPUS; cpu++ {
+		if gdb_halted(cpu) {
+			g.resume(cpu)
+		}
+	}
+	g.give_port()
+}
+
+func (g *gdb_server) first_halted() int {
+	for cpu := 0; cpu < MAX_CPUS; cpu++ {
+		if gdb_halted(cpu) {
+			return cpu
+		}
+	}
+	return -1
+}
+
+//T05thread:1;
+func (g *gdb_server) send_stop(cpu int) {
+	g.begin()
+	g.put('T')
+	g.put_hex8(uint8(g.signal[cpu]))
+	g.put_string("thread:")
+	g.put_hex(uint32(cpu + 1))
+	g.put(';')
+	g.finish()
+}
+
+//Everything that isnt running this server is halted now, so tell gdb about cpu
+func (g *gdb_server) stop(cpu int) {
+	g.take_port()
+	g.halt_others()
+	for c := 0; c < MAX_CPUS; c++ {
+		if gdb_halted(c) {
+			g.classify(c)
+		}
+	}
+	gdb_remove_all(g.temp[:])
+	g.interrupted = false
+	g.stepping = -1
+	g.stopped = true
+	if cpu < 0 {
+		cpu = g.first_halted()
+	}
+	g.cur = cpu
+	if cpu < 0 {
+		//nothing would halt, most likely everything has its IRQs off
+		g.send("S02")
+		return
+	}
+	g.send_stop(cpu)
+}
+
+/*
+* Packets
+ */
+
+func (g *gdb_server) try_getc() (byte, bool) {
+	if c, ok := g.port.rx.get(); ok {
+		return c, true
+	}
+	u := g.port.uart
+	if g.polled && u.regs.usr1&RRDY != 0 {
+		return byte(u.regs.urxd & READ_MASK), true
+	}
+	return 0, false
+}
+
+//only the running side of the server, where nothing is halted, ever waits on the ISR
+func (g *gdb_server) getc() byte {
+	for {
+		if c, ok := g.try_getc(); ok {
+			return c
+		}
+		if !g.polled {
+			g.port.rx_wake.Wait()
+		}
+	}
+}
+
+func (g *gdb_server) write(p []byte) {
+	if !g.polled {
+		g.port.Write(p)
+		return
+	}
+	for _, c := range p {
+		g.port.uart.putchar(c)
+	}
+}
+
+const gdb_hexdigits = "0123456789abcdef"
+
+func (g *gdb_server) begin() {
+	g.out[0] = '$'
+	g.outlen = 1
+}
+
+//drops whatever doesnt fit, which gdb sees as a short reply
+func (g *gdb_server) put(c byte) {
+	if g.outlen < len(g.out)-3 {
+		g.out[g.outlen] = c
+		g.outlen++
+	}
+}
+
+func (g *gdb_server) put_string(s string) {
+	for i := 0; i < len(s); i++ {
+		g.put(s[i])
+	}
+}
+
+func (g *gdb_server) put_hex8(b uint8) {
+	g.put(gdb_hexdigits[b>>4])
+	g.put(gdb_hexdigits[b&0xF])
+}
+
+//without leading zeros
+func (g *gdb_server) put_hex(v uint32) {
+	shift := uint(28)
+	for shift > 0 && (v>>shift)&0xF == 0 {
+		shift -= 4
+	}
+	for {
+		g.put(gdb_hexdigits[(v>>shift)&0xF])
+		if shift == 0 {
+			return
+		}
+		shift -= 4
+	}
+}
+
+//registers go out little endian
+func (g *gdb_server) put_reg(v uint32) {
+	for i := uint(0); i < 4; i++ {
+		g.put_hex8(uint8(v >> (8 * i)))
+	}
+}
+
+//adds #checksum and sends the packet until gdb says +
+func (g *gdb_server) finish() {
+	sum := uint8(0)
+	for _, c := range g.out[1:g.outlen] {
+		sum += c
+	}
+	g.out[g.outlen] = '#'
+	g.out[g.outlen+1] = gdb_hexdigits[sum>>4]
+	g.out[g.outlen+2] = gdb_hexdigits[sum&0xF]
+	pkt := g.out[:g.outlen+3]
+	for {
+		g.write(pkt)
+		c := g.getc()
+		if c == '+' {
+			return
+		}
+		if c == 0x03 {
+			g.interrupted = true
+		}
+	}
+}
+
+func (g *gdb_server) send(data string) {
+	g.begin()
+	g.put_string(data)
+	g.finish()
+}
+
+func gdb_unhex(c byte) (uint32, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return uint32(c - '0'), true
+	case c >= 'a' && c <= 'f':
+		return uint32(c-'a') + 10, true
+	case c >= 'A' && c <= 'F':
+		return uint32(c-'A') + 10, true
+	}
+	return 0, false
+}
+
+//Reads the rest of a packet after its $, acks it, and returns what was in it.
+//The slice is g.in, so it is only good until the next packet.
+func (g *gdb_server) recv() ([]byte, bool) {
+	n := 0
+	overflow := false
+	for {
+		c := g.getc()
+		if c == '#' {
+			break
+		}
+		if c == '$' {
+			n = 0
+			overflow = false
+			continue
+		}
+		if n == len(g.in) {
+			overflow = true
+			continue
+		}
+		g.in[n] = c
+		n++
+	}
+	hi, ok1 := gdb_unhex(g.getc())
+	lo, ok2 := gdb_unhex(g.getc())
+	sum := uint8(0)
+	for _, c := range g.in[:n] {
+		sum += c
+	}
+	if !ok1 || !ok2 || overflow || uint8(hi<<4|lo) != sum {
+		g.ack[0] = '-'
+		g.write(g.ack[:])
+		return nil, false
+	}
+	g.ack[0] = '+'
+	g.write(g.ack[:])
+	return g.in[:n], true
+}
+
+//there is a byte waiting, in the ring or in the uart
+func (g *gdb_server) avail() bool {
+	if g.port.rx.len() != 0 {
+		return true
+	}
+	return g.polled && g.port.uart.regs.usr1&RRDY != 0
+}
+
+func (g *gdb_server) run() {
+	for {
+		if !g.stopped {
+			if g.stepping >= 0 && gdb_halted(g.stepping) {
+				g.stop(g.stepping)
+				continue
+			}
+			if g.stepping < 0 {
+				if cpu := g.first_halted(); cpu >= 0 {
+					g.stop(cpu)
+					continue
+				}
+			}
+			if !g.avail() {
+				//while a step runs the rest are still halted, so keep spinning
+				if g.stepping < 0 {
+					runtime.Gosched()
+				}
+				continue
+			}
+			//ctrl-c, or gdb just connected and wants to know what is going on
+			c := g.getc()
+			if c != 0x03 && c != '$' {
+				continue
+			}
+			g.interrupted = true
+			g.stop(-1)
+			if c == 0x03 {
+				continue
+			}
+			if pkt, ok := g.recv(); ok {
+				g.handle(pkt)
+			}
+			continue
+		}
+		if g.getc() != '$' {
+			continue
+		}
+		if pkt, ok := g.recv(); ok {
+			g.handle(pkt)
+		}
+	}
+}
+
+//Takes hex digits off the front of b. ok is false if there werent any or they dont fit in 32 bits.
+func gdb_parse_hex(b []byte) (uint32, []byte, bool) {
+	v := uint32(0)
+	i := 0
+	for ; i < len(b); i++ {
+		d, ok := gdb_unhex(b[i])
+		if !ok {
+			break
+		}
+		if v>>28 != 0 {
+			return 0, b, false
+		}
+		v = v<<4 | d
+	}
+	return v, b[i:], i > 0
+}
+
+//a whole field of hex digits followed by sep, or by the end if sep is 0
+func gdb_field(b []byte, sep byte) (uint32, []byte, bool) {
+	v, rest, ok := gdb_parse_hex(b)
+	if !ok {
+		return 0, b, false
+	}
+	if sep == 0 {
+		return v, rest, len(rest) == 0
+	}
+	if len(rest) == 0 || rest[0] != sep {
+		return 0, b, false
+	}
+	return v, rest[1:], true
+}
+
+//8 hex digits of a little endian register
+func gdb_unhex32(b []byte) (uint32, bool) {
+	if len(b) != 8 {
+		return 0, false
+	}
+	v := uint32(0)
+	for i := 0; i < 4; i++ {
+		hi, ok1 := gdb_unhex(b[2*i])
+		lo, ok2 := gdb_unhex(b[2*i+1])
+		if !ok1 || !ok2 {
+			return 0, false
+		}
+		v |= (hi<<4 | lo) << (8 * uint(i))
+	}
+	return v, true
+}
+
+func gdb_has_prefix(b []byte, prefix string) bool {
+	return len(b) >= len(prefix) && string(b[:len(prefix)]) == prefix
+}
+
+const gdb_target_xml = `<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target>
+<architecture>arm</architecture>
+<feature name="org.gnu.gdb.arm.core">
+<reg name="r0" bitsize="32"/>
+<reg name="r1" bitsize="32"/>
+<reg name="r2" bitsize="32"/>
+<reg name="r3" bitsize="32"/>
+<reg name="r4" bitsize="32"/>
+<reg name="r5" bitsize="32"/>
+<reg name="r6" bitsize="32"/>
+<reg name="r7" bitsize="32"/>
+<reg name="r8" bitsize="32"/>
+<reg name="r9" bitsize="32"/>
+<reg name="r10" bitsize="32"/>
+<reg name="r11" bitsize="32"/>
+<reg name="r12" bitsize="32"/>
+<reg name="sp" bitsize="32" type="data_ptr"/>
+<reg name="lr" bitsize="32"/>
+<reg name="pc" bitsize="32" type="code_ptr"/>
+<reg name="cpsr" bitsize="32" regnum="25"/>
+</feature>
+</target>
+`
+
+func (g *gdb_server) handle(pkt []byte) {
+	if len(pkt) == 0 {
+		g.send("")
+		return
+	}
+	f := &gdb_frames[g.cur]
+	switch pkt[0] {
+	case '?':
+		g.send_stop(g.cur)
+	case 'g':
+		g.begin()
+		for _, r := range f.r {
+			g.put_reg(r)
+		}
+		g.put_reg(f.cpsr)
+		g.finish()
+	case 'G':
+		if len(pkt) < 1+17*8 {
+			g.send("E01")
+			return
+		}
+		var regs [17]uint32
+		for i := range regs {
+			v, ok := gdb_unhex32(pkt[1+8*i : 9+8*i])
+			if !ok {
+				g.send("E01")
+				return
+			}
+			regs[i] = v
+		}
+		copy(f.r[:], regs[:16])
+		f.cpsr = regs[16]
+		g.send("OK")
+	case 'p':
+		n, _, ok := gdb_field(pkt[1:], 0)
+		switch {
+		case !ok:
+			g.send("E01")
+		case n < 16:
+			g.begin()
+			g.put_reg(f.r[n])
+			g.finish()
+		case n == 25:
+			g.begin()
+			g.put_reg(f.cpsr)
+			g.finish()
+		default:
+			g.send("E01")
+		}
+	case 'P':
+		n, rest, ok := gdb_field(pkt[1:], '=')
+		v, ok2 := gdb_unhex32(rest)
+		switch {
+		case !ok || !ok2:
+			g.send("E01")
+		case n < 16:
+			f.r[n] = v
+			g.send("OK")
+		case n == 25:
+			f.cpsr = v
+			g.send("OK")
+		default:
+			g.send("E01")
+		}
+	case 'm':
+		addr, rest, ok := gdb_field(pkt[1:], ',')
+		length, _, ok2 := gdb_field(rest, 0)
+		if !ok || !ok2 {
+			g.send("E01")
+			return
+		}
+		g.begin()
+		for i := uint32(0); i < length && g.outlen+2 <= len(g.out)-3; i++ {
+			g.put_hex8(*(*byte)(unsafe.Pointer(uintptr(addr + i))))
+		}
+		g.finish()
+	case 'M':
+		addr, rest, ok := gdb_field(pkt[1:], ',')
+		length, data, ok2 := gdb_field(rest, ':')
+		if !ok || !ok2 || uint32(len(data)) != 2*length {
+			g.send("E01")
+			return
+		}
+		for i := uint32(0); i < length; i++ {
+			hi, ok1 := gdb_unhex(data[2*i])
+			lo, ok2 := gdb_unhex(data[2*i+1])
+			if !ok1 || !ok2 {
+				g.send("E01")
+				return
+			}
+			*(*byte)(unsafe.Pointer(uintptr(addr + i))) = byte(hi<<4 | lo)
+		}
+		for a := addr &^ 31; a < addr+length; a += 32 {
+			gdb_sync_icache(a)
+		}
+		g.send("OK")
+	case 'c':
+		if pc, _, ok := gdb_field(pkt[1:], 0); ok {
+			f.r[15] = pc
+		}
+		g.stopped = false
+		g.resume_all()
+	case 's':
+		if pc, _, ok := gdb_field(pkt[1:], 0); ok {
+			f.r[15] = pc
+		}
+		next, n, err := gdb_next_pcs(f)
+		if err != nil {
+			g.send("E01")
+			return
+		}
+		for _, addr := range next[:n] {
+			if gdb_find(g.breakpoints[:], addr) != nil || gdb_find(g.temp[:], addr) != nil {
+				continue
+			}
+			gdb_insert(g.temp[:], addr)
+		}
+		//only the stepping cpu runs, the rest stay halted and the uart stays ours
+		g.stopped = false
+		g.stepping = g.cur
+		g.resume(g.cur)
+	case 'Z', 'z':
+		kind, rest, ok := gdb_field(pkt[1:], ',')
+		if !ok || kind != 0 {
+			g.send("")
+			return
+		}
+		addr, _, ok := gdb_field(rest, ',')
+		if !ok || addr&3 != 0 {
+			g.send("E01")
+			return
+		}
+		b := gdb_find(g.breakpoints[:], addr)
+		if pkt[0] == 'Z' && b == nil {
+			if !gdb_insert(g.breakpoints[:], addr) {
+				g.send("E02")
+				return
+			}
+		} else if pkt[0] == 'z' && b != nil {
+			gdb_remove(b)
+		}
+		g.send("OK")
+	case 'H':
+		if len(pkt) < 2 {
+			g.send("E01")
+			return
+		}
+		//-1 means all threads and 0 any thread
+		if pkt[1] == 'c' || string(pkt[2:]) == "-1" || string(pkt[2:]) == "0" {
+			g.send("OK")
+			return
+		}
+		id, _, ok := gdb_field(pkt[2:], 0)
+		if !ok || id < 1 || id > MAX_CPUS || !gdb_halted(int(id-1)) {
+			g.send("E01")
+			return
+		}
+		g.cur = int(id - 1)
+		g.send("OK")
+	case 'T':
+		id, _, ok := gdb_field(pkt[1:], 0)
+		if !ok || id < 1 || id > MAX_CPUS || !gdb_halted(int(id-1)) {
+			g.send("E01")
+			return
+		}
+		g.send("OK")
+	case 'D', 'k':
+		gdb_remove_all(g.breakpoints[:])
+		if pkt[0] == 'D' {
+			g.send("OK")
+		}
+		g.stopped = false
+		g.resume_all()
+	case 'q':
+		g.query(pkt)
+	default:
+		g.send("")
+	}
+}
+
+func (g *gdb_server) query(pkt []byte) {
+	const xfer = "qXfer:features:read:target.xml:"
+	switch {
+	case gdb_has_prefix(pkt, "qSupported"):
+		g.send("PacketSize=1000;qXfer:features:read+")
+	case gdb_has_prefix(pkt, xfer):
+		off, rest, ok := gdb_field(pkt[len(xfer):], ',')
+		length, _, ok2 := gdb_field(rest, 0)
+		if !ok || !ok2 {
+			g.send("E01")
+			return
+		}
+		if off >= uint32(len(gdb_target_xml)) {
+			g.send("l")
+			return
+		}
+		end := off + length
+		g.begin()
+		if end >= uint32(len(gdb_target_xml)) {
+			g.put('l')
+			end = uint32(len(gdb_target_xml))
+		} else {
+			g.put('m')
+		}
+		g.put_string(gdb_target_xml[off:end])
+		g.finish()
+	case string(pkt) == "qC":
+		g.begin()
+		g.put_string("QC")
+		g.put_hex(uint32(g.cur + 1))
+		g.finish()
+	case string(pkt) == "qfThreadInfo":
+		g.begin()
+		g.put('m')
+		first := true
+		for cpu := 0; cpu < MAX_CPUS; cpu++ {
+			if !gdb_halted(cpu) {
+				continue
+			}
+			if !first {
+				g.put(',')
+			}
+			g.put_hex(uint32(cpu + 1))
+			first = false
+		}
+		g.finish()
+	case string(pkt) == "qsThreadInfo":
+		g.send("l")
+	case string(pkt) == "qAttached":
+		g.send("1")
+	case gdb_has_prefix(pkt, "qThreadExtraInfo,"):
+		id, _, _ := gdb_field(pkt[len("qThreadExtraInfo,"):], 0)
+		//"cpuN" in hex
+		g.begin()
+		g.put_string("637075")
+		g.put_hex8('0' + uint8(id-1)%10)
+		g.finish()
+	default:
+		g.send("")
+	}
+}
+
+/*
+* Software single step. These are the ARM instructions that can write pc.
+* A conditional one might not, so pc+4 always gets a breakpoint too unless the instruction always branches.
+ */
+
+func gdb_reg(f *gdb_frame, n uint32) uint32 {
+	if n == 15 {
+		return f.r[15] + 8
+	}
+	return f.r[n]
+}
+
+//the shifter operand of a data processing instruction, or the offset of a load with a register offset
+func gdb_shift(f *gdb_frame, insn uint32) (uint32, error) {
+	if insn&0x10 != 0 {
+		return 0, gdb_err_shift
+	}
+	rm := gdb_reg(f, insn&0xF)
+	amount := (insn >> 7) & 0x1F
+	switch (insn >> 5) & 0x3 {
+	case 0:
+		return rm << amount, nil
+	case 1:
+		if amount == 0 {
+			return 0, nil
+		}
+		return rm >> amount, nil
+	case 2:
+		if amount == 0 {
+			amount = 31
+		}
+		return uint32(int32(rm) >> amount), nil
+	default:
+		if amount == 0 {
+			return 0, gdb_err_rrx
+		}
+		return (rm >> amount) | (rm << (32 - amount)), nil
+	}
+}
+
+func gdb_target(f *gdb_frame, insn uint32) (uint32, bool, error) {
+	pc := f.r[15]
+	carry := (f.cpsr >> 29) & 1
+	switch {
+	case insn&0x0E000000 == 0x0A000000:
+		//B, BL
+		offset := int32(insn<<8) >> 6
+		return uint32(int32(pc) + 8 + offset), true, nil
+	case insn&0x0FFFFFD0 == 0x012FFF10:
+		//BX, BLX register
+		target := gdb_reg(f, insn&0xF)
+		if target&1 != 0 {
+			return 0, false, gdb_err_thumb
+		}
+		return target, true, nil
+	case insn&0x0C000000 == 0 && (insn>>12)&0xF == 15:
+		//data processing into pc
+		op := (insn >> 21) & 0xF
+		if op >= 8 && op <= 11 {
+			return 0, false, nil
+		}
+		var op2 uint32
+		if insn&(1<<25) != 0 {
+			rot := ((insn >> 8) & 0xF) * 2
+			imm := insn & 0xFF
+			op2 = (imm >> rot) | (imm << ((32 - rot) & 31))
+		} else {
+			var err error
+			if op2, err = gdb_shift(f, insn); err != nil {
+				return 0, false, err
+			}
+		}
+		rn := gdb_reg(f, (insn>>16)&0xF)
+		results := [16]uint32{
+			rn & op2, rn ^ op2, rn - op2, op2 - rn, rn + op2, rn + op2 + carry, rn - op2 - 1 + carry, op2 - rn - 1 + carry,
+			0, 0, 0, 0, rn | op2, op2, rn &^ op2, ^op2,
+		}
+		return results[op], true, nil
+	case insn&0x0C500000 == 0x04100000 && (insn>>12)&0xF == 15:
+		//LDR pc
+		base := gdb_reg(f, (insn>>16)&0xF)
+		offset := insn & 0xFFF
+		if insn&(1<<25) != 0 {
+			var err error
+			if offset, err = gdb_shift(f, insn); err != nil {
+				return 0, false, err
+			}
+		}
+		addr := base
+		if insn&(1<<24) != 0 {
+			if insn&(1<<23) != 0 {
+				addr += offset
+			} else {
+				addr -= offset
+			}
+		}
+		return gdb_read32(addr), true, nil
+	case insn&0x0E108000 == 0x08108000:
+		//LDM with pc in the list
+		base := gdb_reg(f, (insn>>16)&0xF)
+		n := uint32(0)
+		for i := uint32(0); i < 16; i++ {
+			n += (insn >> i) & 1
+		}
+		var addr uint32
+		switch (insn >> 23) & 0x3 {
+		case 0: //DA
+			addr = base
+		case 1: //IA
+			addr = base + 4*(n-1)
+		case 2: //DB
+			addr = base - 4
+		case 3: //IB
+			addr = base + 4*n
+		}
+		return gdb_read32(addr), true, nil
+	}
+	return 0, false, nil
+}
+
+//every address the instruction at pc might go to next, and how many there are
+func gdb_next_pcs(f *gdb_frame) ([2]uint32, int, error) {
+	pc := f.r[15]
+	if f.cpsr&(1<<5) != 0 {
+		return [2]uint32{}, 0, gdb_err_thumb
+	}
+	insn := gdb_read32(pc)
+	if insn>>28 == 0xF {
+		//the unconditional space is BLX to thumb and hints
+		if insn&0x0E000000 == 0x0A000000 {
+			return [2]uint32{}, 0, gdb_err_thumb
+		}
+		return [2]uint32{pc + 4}, 1, nil
+	}
+	target, branches, err := gdb_target(f, insn)
+	if err != nil {
+		return [2]uint32{}, 0, err
+	}
+	if !branches {
+		return [2]uint32{pc + 4}, 1, nil
+	}
+	if insn>>28 == 0xE || target == pc+4 {
+		return [2]uint32{target}, 1, nil
+	}
+	return [2]uint32{pc + 4, target}, 2, nil
+}
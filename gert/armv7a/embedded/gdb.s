@@ -0,0 +1,103 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+#include "textflag.h"
+
+#define GDB_FRAME_SP     52
+#define GDB_FRAME_LR     56
+#define GDB_FRAME_PC     60
+#define GDB_FRAME_CPSR   64
+#define GDB_FRAME_HALTED 68
+
+// The undefined instruction vector branches here. SP_und of every cpu points at its gdb_frame,
+// so this saves the registers there, raises halted, and spins until the gdb server lowers it again.
+// Then it puts back whatever registers gdb left in the frame and returns to the pc in it.
+// IRQs stay off the whole time, which is what keeps a halted cpu halted.
+TEXT ·gdb_und_vector(SB), NOSPLIT, $-4
+	MOVM.IA [R0-R12], (R13)
+	MOVW    R13, R6
+	SUB     $4, R14, R0
+	MOVW    R0, GDB_FRAME_PC(R6)
+	WORD    $0xe14f1000              // mrs r1, spsr
+	MOVW    R1, GDB_FRAME_CPSR(R6)
+
+	// sp and lr are banked, so go get them from the mode that trapped.
+	// User mode shares them with system mode, which we are allowed to switch to.
+	AND     $0x1F, R1, R2
+	CMP     $0x10, R2
+	MOVW.EQ $0x1F, R2
+	ORR     $0xC0, R2
+	WORD    $0xe10f3000              // mrs r3, cpsr
+	WORD    $0xe121f002              // msr cpsr_c, r2
+	MOVW    R13, R4
+	MOVW    R14, R5
+	WORD    $0xe121f003              // msr cpsr_c, r3
+	MOVW    R4, GDB_FRAME_SP(R6)
+	MOVW    R5, GDB_FRAME_LR(R6)
+
+	WORD    $0xf57ff05f              // dmb
+	MOVW    $1, R0
+	MOVW    R0, GDB_FRAME_HALTED(R6)
+	WORD    $0xf57ff04f              // dsb
+halted:
+	MOVW    GDB_FRAME_HALTED(R6), R0
+	CMP     $0, R0
+	BNE     halted
+	WORD    $0xf57ff05f              // dmb
+
+	MOVW    GDB_FRAME_CPSR(R6), R1
+	WORD    $0xe16ff001              // msr spsr_cxsf, r1
+	AND     $0x1F, R1, R2
+	CMP     $0x10, R2
+	MOVW.EQ $0x1F, R2
+	ORR     $0xC0, R2
+	MOVW    GDB_FRAME_SP(R6), R4
+	MOVW    GDB_FRAME_LR(R6), R5
+	WORD    $0xe10f3000              // mrs r3, cpsr
+	WORD    $0xe121f002              // msr cpsr_c, r2
+	MOVW    R4, R13
+	MOVW    R5, R14
+	WORD    $0xe121f003              // msr cpsr_c, r3
+	MOVW    GDB_FRAME_PC(R6), R14
+	MOVM.IA (R6), [R0-R12]
+	WORD    $0xe1b0f00e              // movs pc, lr
+
+// func gdb_und_vector_addr() uint32
+TEXT ·gdb_und_vector_addr(SB), NOSPLIT, $0-4
+	MOVW $·gdb_und_vector(SB), R0
+	MOVW R0, ret+0(FP)
+	RET
+
+// func gdb_vbar() uint32
+TEXT ·gdb_vbar(SB), NOSPLIT, $0-4
+	WORD $0xee1c0f10     // mrc p15, 0, r0, c12, c0, 0 (VBAR)
+	MOVW R0, ret+0(FP)
+	RET
+
+// func gdb_set_und_stack(frame uint32)
+TEXT ·gdb_set_und_stack(SB), NOSPLIT, $0-4
+	MOVW frame+0(FP), R0
+	WORD $0xe10f3000     // mrs r3, cpsr
+	MOVW $0xDB, R2       // undefined mode, IRQ and FIQ off
+	WORD $0xe121f002     // msr cpsr_c, r2
+	MOVW R0, R13
+	WORD $0xe121f003     // msr cpsr_c, r3
+	RET
+
+// func gdb_sync_icache(addr uint32)
+TEXT ·gdb_sync_icache(SB), NOSPLIT, $0-4
+	MOVW addr+0(FP), R0
+	WORD $0xee070f3b     // mcr p15, 0, r0, c7, c11, 1 (DCCMVAU)
+	WORD $0xf57ff04f     // dsb
+	MOVW $0, R0
+	WORD $0xee070f11     // mcr p15, 0, r0, c7, c1, 0 (ICIALLUIS)
+	WORD $0xee070fd1     // mcr p15, 0, r0, c7, c1, 6 (BPIALLIS)
+	WORD $0xf57ff04f     // dsb
+	WORD $0xf57ff06f     // isb
+	RET
+
+// func Gdb_break()
+TEXT ·Gdb_break(SB), NOSPLIT, $0-0
+	WORD $0xe7ffdefe     // the undefined instruction gdb uses for breakpoints
+	RET
@@ -49,7 +49,17 @@ var gpios = [...]*gpio{
 	((*gpio)(unsafe.Pointer(uintptr(GPIO7_BASE)))),
 }
 
-var int_table [6][32]func()
+//GIC SPI numbers of the combined GPIO interrupts. Every bank has two,
+//one for pins 0-15 and one for pins 16-31, starting at GPIO1 pins 0-15.
+//Section 3.2 from iMX6 Quad Applications Manual
+const (
+	GPIO_IRQ_BASE     = 98
+	GPIO_IRQ_LAST     = 111
+	GPIO_IRQ_PRIORITY = 0xA0
+)
+
+//handlers registered with EnableIntr, indexed by [bank-1][pin]
+var int_table [len(gpios)][32]func()
 
 func Set(ptr unsafe.Pointer, val uint32)
 
@@ -72,6 +82,7 @@ const (
 	INTR_HIGH    = 1
 	INTR_RISING  = 2
 	INTR_FALLING = 3
+	INTR_BOTH    = 4
 )
 
 //static functions for the toggle benchmark
@@ -92,22 +103,30 @@ func ClearIntr(gpiobank uint8) {
 	gpio.isr = 0xFFFFFFFF
 }
 
+//Dispatches a combined GPIO interrupt to the handlers registered with EnableIntr.
+//EnableIntr puts this in the interrupt table, but you can also call it from irq()
+//for any irqnum between GPIO_IRQ_BASE and GPIO_IRQ_LAST.
 //go:nosplit
 //go:nowritebarrierec
 func GPIO_ISR(num uint32) {
-	switch num {
-	case 102:
-	case 103:
-		//read which pins caused interrupt
-		mask := gpios[2].isr
-		for i := uint32(0); i < 31; i++ {
-			if (mask & (0x1 << i)) > 0 {
-				int_table[2][i]()
+	if num < GPIO_IRQ_BASE || num > GPIO_IRQ_LAST {
+		return
+	}
+	bank := (num - GPIO_IRQ_BASE) / 2
+	first := ((num - GPIO_IRQ_BASE) % 2) * 16
+	gpio := gpios[bank]
+
+	//read which pins caused interrupt, only looking at our half of the bank
+	mask := gpio.isr & gpio.imr & (0xFFFF << first)
+
+	//clear them before running the handlers so that we dont lose edges
+	gpio.isr = mask
+	for i := first; i < first+16; i++ {
+		if (mask & (0x1 << i)) > 0 {
+			if handler := int_table[bank][i]; handler != nil {
+				handler()
 			}
 		}
-		//clear them
-		gpios[2].isr = mask
-	default:
 	}
 }
 
@@ -183,24 +202,46 @@ func (pin GPIO_pin) GetPinNum() uint32 {
 	return GetPinNum(pin.base, pin.offset)
 }
 
-func (pin GPIO_pin) EnableIntr(mode uint8) {
-	mode &= 0x3
-	//int_table[pin.base-1][pin.offset] = intr_func
-	if pin.offset >= 16 {
-		icr := &pin.gpioregs.icr2
-		offset := pin.offset - 16
-		*icr |= uint32(mode) << (2 * offset)
+//returns the GIC SPI number that this pin interrupts on
+func (pin GPIO_pin) GetIRQnum() uint32 {
+	return GPIO_IRQ_BASE + (pin.base-1)*2 + pin.offset/16
+}
+
+//Registers handler to run when the pin sees the event described by mode and routes the
+//GIC interrupt for the pin's bank to GPIO_ISR on CPU0. Use Register_interrupt with GetIRQnum to send it somewhere else.
+//The handler runs in IRQ mode from GPIO_ISR, so it must be nosplit and must not block or allocate.
+//section 28.4.3.3
+func (pin GPIO_pin) EnableIntr(mode uint8, handler func()) {
+	//mask it while we change things
+	pin.gpioregs.imr &= ^(0x1 << pin.offset)
+	int_table[pin.base-1][pin.offset] = handler
+
+	if mode == INTR_BOTH {
+		//edge_sel overrides whatever is in icr
+		pin.gpioregs.edge_sel |= 0x1 << pin.offset
 	} else {
+		pin.gpioregs.edge_sel &= ^(0x1 << pin.offset)
+		mode &= 0x3
 		icr := &pin.gpioregs.icr1
 		offset := pin.offset
-		*icr |= uint32(mode) << (2 * offset)
+		if pin.offset >= 16 {
+			icr = &pin.gpioregs.icr2
+			offset = pin.offset - 16
+		}
+		*icr = (*icr & ^(uint32(0x3) << (2 * offset))) | (uint32(mode) << (2 * offset))
 	}
+
+	//throw away anything that happened before now
+	pin.gpioregs.isr = 0x1 << pin.offset
 	pin.gpioregs.imr |= 0x1 << pin.offset
+
+	Register_interrupt(pin.GetIRQnum(), 0, GPIO_IRQ_PRIORITY, GPIO_ISR, nil)
 }
 
 func (pin GPIO_pin) DisableIntr() {
 	//just mask the interrupt
 	pin.gpioregs.imr &= ^(0x1 << pin.offset)
+	int_table[pin.base-1][pin.offset] = nil
 }
 
 ////
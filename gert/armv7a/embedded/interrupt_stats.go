@@ -0,0 +1,131 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package embedded
+
+import "fmt"
+import "io"
+import "os"
+import "runtime"
+
+/*
+* Bookkeeping for Dispatch_interrupt so you can see which IRQs fire, where, and for how long.
+* Handlers are timed with the low 32 bits of the Cortex-A9 global timer, which ticks at PERIPHCLK.
+* Every cpu only ever writes its own column, so the ISRs dont need locks.
+ */
+
+//PERIPHCLK is half the cpu clock. U-boot leaves the cpu at 792MHz
+const PERIPHCLK_HZ = 396000000
+
+type interrupt_stat struct {
+	count [MAX_CPUS]uint32
+	ticks [MAX_CPUS]uint64
+	max   [MAX_CPUS]uint32
+}
+
+var interrupt_stats [MAX_INTERRUPTS]interrupt_stat
+var interrupt_stats_enabled bool
+
+//Starts counting and timing every interrupt that goes through Dispatch_interrupt.
+//This turns on the global timer if nobody else has.
+func Enable_interrupt_stats() {
+	Global_timer_start()
+	interrupt_stats_enabled = true
+}
+
+func Disable_interrupt_stats() {
+	interrupt_stats_enabled = false
+}
+
+func Reset_interrupt_stats() {
+	for i := range interrupt_stats {
+		interrupt_stats[i] = interrupt_stat{}
+	}
+}
+
+//go:nosplit
+func interrupt_stats_now() uint32 {
+	return global_timer_read_lo()
+}
+
+//go:nosplit
+//go:nowritebarrierec
+func interrupt_stats_record(irqnum uint32, cpu uint32, start uint32) {
+	elapsed := interrupt_stats_now() - start
+	stat := &interrupt_stats[irqnum]
+	stat.count[cpu&(MAX_CPUS-1)] += 1
+	stat.ticks[cpu&(MAX_CPUS-1)] += uint64(elapsed)
+	if elapsed > stat.max[cpu&(MAX_CPUS-1)] {
+		stat.max[cpu&(MAX_CPUS-1)] = elapsed
+	}
+}
+
+//Returns how many times num fired on each cpu and the longest and average
+//time its handler took on any cpu, in nanoseconds
+func Interrupt_stats(num uint32) (counts [MAX_CPUS]uint32, max uint32, avg uint32) {
+	if num >= MAX_INTERRUPTS {
+		return
+	}
+	stat := interrupt_stats[num]
+	total := uint32(0)
+	ticks := uint64(0)
+	for cpu := 0; cpu < MAX_CPUS; cpu++ {
+		counts[cpu] = stat.count[cpu]
+		total += stat.count[cpu]
+		ticks += stat.ticks[cpu]
+		if stat.max[cpu] > max {
+			max = stat.max[cpu]
+		}
+	}
+	max = ticks2ns(uint64(max))
+	if total > 0 {
+		avg = ticks2ns(ticks / uint64(total))
+	}
+	return
+}
+
+func ticks2ns(ticks uint64) uint32 {
+	return uint32((ticks * 1000000000) / PERIPHCLK_HZ)
+}
+
+//Prints the counters of every interrupt that fired at least once
+func Print_interrupt_stats() {
+	Fprint_interrupt_stats(os.Stdout)
+}
+
+func Fprint_interrupt_stats(w io.Writer) {
+	fmt.Fprintf(w, "irq      cpu0      cpu1      cpu2      cpu3   max(ns)   avg(ns)\r\n")
+	for num := uint32(0); num < MAX_INTERRUPTS; num++ {
+		counts, max, avg := Interrupt_stats(num)
+		if counts[0]+counts[1]+counts[2]+counts[3] == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%3d %9d %9d %9d %9d %9d %9d\r\n", num, counts[0], counts[1], counts[2], counts[3], max, avg)
+	}
+}
+
+//Prints what the distributor thinks of every interrupt that is enabled or has a handler.
+//The SGI and PPI state is banked, so for those this is the view of the calling cpu.
+func Print_interrupt_state() {
+	Fprint_interrupt_state(os.Stdout)
+}
+
+func Fprint_interrupt_state(w io.Writer) {
+	fmt.Fprintf(w, "irq enabled pending active priority targets trigger handler\r\n")
+	for num := uint32(0); num < MAX_INTERRUPTS; num++ {
+		registered := interrupt_lookup(num, uint32(runtime.Cpunum())).handler != nil
+		if !registered && !Interrupt_enabled(num) {
+			continue
+		}
+		trigger := "level"
+		if Interrupt_trigger(num) == TRIGGER_EDGE {
+			trigger = "edge"
+		}
+		fmt.Fprintf(w, "%3d %7v %7v %6v     0x%02x    0x%02x %7s %7v\r\n", num,
+			Interrupt_enabled(num), Interrupt_pending(num), Interrupt_active(num),
+			gic_distributor.interrupt_priority_registers[num],
+			gic_distributor.interrupt_processor_targets_registers[num],
+			trigger, registered)
+	}
+}
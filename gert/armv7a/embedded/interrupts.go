@@ -0,0 +1,134 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package embedded
+
+import "runtime"
+
+/*
+* A table of interrupt handlers so that drivers can hook their own ISRs instead of
+* everyone editing the switch statement in irq.go.
+* Everything in here runs in IRQ mode so the same rules apply as in irq.go:
+* no blocking operations and no allocations on the heap.
+ */
+
+//the iMX6 GIC has 32 private interrupts and 128 shared peripheral interrupts
+const MAX_INTERRUPTS = 160
+
+//PPIs 16-31 are banked, every cpu has its own timer interrupts and so on behind the same number
+const (
+	FIRST_PPI = 16
+	LAST_PPI  = 31
+)
+
+type Interrupt_handler func(irqnum uint32)
+
+type interrupt_entry struct {
+	handler     Interrupt_handler
+	clear       func()
+	cpunum      uint32
+	priority    uint8
+	preemptible bool
+}
+
+var interrupt_table [MAX_INTERRUPTS]interrupt_entry
+
+//handlers for one cpu's own PPIs, which win over interrupt_table on that cpu
+var private_table [MAX_CPUS][LAST_PPI - FIRST_PPI + 1]interrupt_entry
+
+//Makes Dispatch_interrupt the IRQ callback of the runtime. Call this instead of
+//runtime.SetIRQcallback if you dont have your own irq() switch.
+func Interrupt_table_init() {
+	runtime.SetIRQcallback(Dispatch_interrupt)
+}
+
+//Routes interrupt num to cpunum with the given priority and runs handler whenever it fires.
+//If clear is not nil it is called after the handler to clear the peripheral's status.
+//Both handler and clear run in IRQ mode so they must be nosplit and must not block or allocate.
+func Register_interrupt(num uint32, cpunum uint32, priority uint8, handler Interrupt_handler, clear func()) {
+	if num >= MAX_INTERRUPTS {
+		panic("interrupt number out of range")
+	}
+	//turn it off while the entry is inconsistent
+	Disable_interrupt(num)
+	interrupt_table[num] = interrupt_entry{handler, clear, cpunum, priority, false}
+	runtime.DMB()
+	Enable_interrupt(num, cpunum, priority)
+}
+
+//Disables interrupt num in the GIC and forgets its handler
+func Unregister_interrupt(num uint32) {
+	if num >= MAX_INTERRUPTS {
+		return
+	}
+	Disable_interrupt(num)
+	interrupt_table[num] = interrupt_entry{}
+}
+
+//Runs handler when PPI num fires on the calling cpu. The other cpus keep their own handlers for num,
+//so call this from code that is known to run on the cpu you want and check runtime.Cpunum().
+func Register_private_interrupt(num uint32, priority uint8, handler Interrupt_handler, clear func()) {
+	if num < FIRST_PPI || num > LAST_PPI {
+		panic("not a private peripheral interrupt")
+	}
+	cpu := uint32(runtime.Cpunum())
+	//the enable bits of PPIs are banked too, so this only turns it off for us
+	Disable_interrupt(num)
+	private_table[cpu][num-FIRST_PPI] = interrupt_entry{handler, clear, cpu, priority, false}
+	runtime.DMB()
+	Enable_interrupt(num, cpu, priority)
+}
+
+//Disables PPI num on the calling cpu and forgets its handler there
+func Unregister_private_interrupt(num uint32) {
+	if num < FIRST_PPI || num > LAST_PPI {
+		return
+	}
+	Disable_interrupt(num)
+	private_table[runtime.Cpunum()][num-FIRST_PPI] = interrupt_entry{}
+}
+
+//the entry that handles irqnum on cpu
+//go:nosplit
+func interrupt_lookup(irqnum uint32, cpu uint32) *interrupt_entry {
+	if irqnum >= FIRST_PPI && irqnum <= LAST_PPI && cpu < MAX_CPUS {
+		if entry := &private_table[cpu][irqnum-FIRST_PPI]; entry.handler != nil {
+			return entry
+		}
+	}
+	return &interrupt_table[irqnum]
+}
+
+//Runs the handler registered for irqnum. Either pass this to runtime.SetIRQcallback
+//or call it from the default case of your own irq() switch.
+//go:nosplit
+//go:nowritebarrierec
+func Dispatch_interrupt(irqnum uint32) {
+	if irqnum >= MAX_INTERRUPTS {
+		//spurious
+		return
+	}
+	stats := interrupt_stats_enabled
+	start := uint32(0)
+	if stats {
+		start = interrupt_stats_now()
+	}
+	entry := interrupt_lookup(irqnum, uint32(runtime.Cpunum()))
+	handler := entry.handler
+	clr := entry.clear
+	if handler != nil {
+		if preemption_enabled && entry.preemptible {
+			gic_cpu.binary_point_register = preemption_binary_point
+			preempt_call(handler, irqnum)
+		} else {
+			handler(irqnum)
+		}
+	}
+	if clr != nil {
+		clr()
+	}
+	if stats {
+		interrupt_stats_record(irqnum, uint32(runtime.Cpunum()), start)
+	}
+}
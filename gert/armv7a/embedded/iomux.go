@@ -98,6 +98,42 @@ var IOMUX_PAD_CTL_SD4_DATA2 = ((*uint32)(unsafe.Pointer(uintptr(0x20E070C))))
 var IOMUX_PAD_CTL_DISP0_DAT8 = ((*uint32)(unsafe.Pointer(uintptr(0x20E04A4))))
 var IOMUX_PAD_CTL_DISP0_DAT9 = ((*uint32)(unsafe.Pointer(uintptr(0x20E04A8))))
 
+//UART
+var IOMUX_MUX_CTL_CSI0_DAT10 = ((*uint32)(unsafe.Pointer(uintptr(0x20E0280))))
+var IOMUX_MUX_CTL_CSI0_DAT11 = ((*uint32)(unsafe.Pointer(uintptr(0x20E0284))))
+var IOMUX_MUX_CTL_EIM_D23 = ((*uint32)(unsafe.Pointer(uintptr(0x20E00AC))))
+var IOMUX_MUX_CTL_EIM_EB3 = ((*uint32)(unsafe.Pointer(uintptr(0x20E00B0))))
+var IOMUX_MUX_CTL_EIM_D24 = ((*uint32)(unsafe.Pointer(uintptr(0x20E00B4))))
+var IOMUX_MUX_CTL_EIM_D25 = ((*uint32)(unsafe.Pointer(uintptr(0x20E00B8))))
+var IOMUX_MUX_CTL_KEY_COL0 = ((*uint32)(unsafe.Pointer(uintptr(0x20E01F8))))
+var IOMUX_MUX_CTL_KEY_ROW0 = ((*uint32)(unsafe.Pointer(uintptr(0x20E01FC))))
+var IOMUX_MUX_CTL_KEY_COL1 = ((*uint32)(unsafe.Pointer(uintptr(0x20E0200))))
+var IOMUX_MUX_CTL_KEY_ROW1 = ((*uint32)(unsafe.Pointer(uintptr(0x20E0204))))
+
+var IOMUX_PAD_CTL_CSI0_DAT10 = ((*uint32)(unsafe.Pointer(uintptr(0x20E0650))))
+var IOMUX_PAD_CTL_CSI0_DAT11 = ((*uint32)(unsafe.Pointer(uintptr(0x20E0654))))
+var IOMUX_PAD_CTL_EIM_D23 = ((*uint32)(unsafe.Pointer(uintptr(0x20E03C0))))
+var IOMUX_PAD_CTL_EIM_EB3 = ((*uint32)(unsafe.Pointer(uintptr(0x20E03C4))))
+var IOMUX_PAD_CTL_EIM_D24 = ((*uint32)(unsafe.Pointer(uintptr(0x20E03C8))))
+var IOMUX_PAD_CTL_EIM_D25 = ((*uint32)(unsafe.Pointer(uintptr(0x20E03CC))))
+var IOMUX_PAD_CTL_KEY_COL0 = ((*uint32)(unsafe.Pointer(uintptr(0x20E05C8))))
+var IOMUX_PAD_CTL_KEY_ROW0 = ((*uint32)(unsafe.Pointer(uintptr(0x20E05CC))))
+var IOMUX_PAD_CTL_KEY_COL1 = ((*uint32)(unsafe.Pointer(uintptr(0x20E05D0))))
+var IOMUX_PAD_CTL_KEY_ROW1 = ((*uint32)(unsafe.Pointer(uintptr(0x20E05D4))))
+
+//daisy chain selects for uart inputs that can come from more than one pad
+var IOMUX_UART1_RX_SELECT_INPUT = ((*uint32)(unsafe.Pointer(uintptr(0x20E0920))))
+var IOMUX_UART2_RX_SELECT_INPUT = ((*uint32)(unsafe.Pointer(uintptr(0x20E0928))))
+var IOMUX_UART3_RTS_SELECT_INPUT = ((*uint32)(unsafe.Pointer(uintptr(0x20E092C))))
+var IOMUX_UART3_RX_SELECT_INPUT = ((*uint32)(unsafe.Pointer(uintptr(0x20E0930))))
+var IOMUX_UART4_RX_SELECT_INPUT = ((*uint32)(unsafe.Pointer(uintptr(0x20E0938))))
+var IOMUX_UART5_RX_SELECT_INPUT = ((*uint32)(unsafe.Pointer(uintptr(0x20E0940))))
+var IOMUX_ECSPI1_CSPI_CLK_IN_SELECT_INPUT = ((*uint32)(unsafe.Pointer(uintptr(0x20E07F4))))
+var IOMUX_ECSPI1_MISO_SELECT_INPUT = ((*uint32)(unsafe.Pointer(uintptr(0x20E07F8))))
+var IOMUX_ECSPI1_MOSI_SELECT_INPUT = ((*uint32)(unsafe.Pointer(uintptr(0x20E07FC))))
+var IOMUX_ECSPI1_SS0_SELECT_INPUT = ((*uint32)(unsafe.Pointer(uintptr(0x20E0800))))
+var IOMUX_ECSPI1_SS1_SELECT_INPUT = ((*uint32)(unsafe.Pointer(uintptr(0x20E0804))))
+
 //go:nosplit
 func usdhc_iomux_config(instance uint32) {
 	switch instance {
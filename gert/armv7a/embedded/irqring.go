@@ -0,0 +1,137 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package embedded
+
+import "sync/atomic"
+
+/*
+* ISRs cannot block or allocate, so they cannot send on a channel. This is a ring of
+* preallocated slots that any number of ISRs (on any cpu) can push into without locks.
+* A goroutine drains it with Recv or by reading the channel that Chan gives back.
+* This is the bounded queue by Dmitry Vyukov. Every slot has a sequence number which says
+* whether it is ready to be written or ready to be read, so a producer that gets interrupted
+* halfway through a push never wedges the other producers.
+ */
+
+type IRQ_event struct {
+	Source uint32
+	Value  uint32
+}
+
+type irq_slot struct {
+	seq   uint32
+	event IRQ_event
+}
+
+type IRQ_ring struct {
+	slots   []irq_slot
+	mask    uint32
+	head    uint32
+	tail    uint32
+	pushed  uint32
+	dropped uint32
+	wake    Wakeup
+}
+
+//size gets rounded up to a power of 2. Call this from a goroutine, not an ISR.
+func MakeIRQring(size uint32) *IRQ_ring {
+	n := uint32(1)
+	for n < size {
+		n <<= 1
+	}
+	r := &IRQ_ring{slots: make([]irq_slot, n), mask: n - 1}
+	for i := range r.slots {
+		r.slots[i].seq = uint32(i)
+	}
+	return r
+}
+
+//Safe to call from an ISR. Returns false and counts a drop if the ring is full.
+//go:nosplit
+//go:nowritebarrierec
+func (r *IRQ_ring) Push(event IRQ_event) bool {
+	for {
+		pos := atomic.LoadUint32(&r.head)
+		slot := &r.slots[pos&r.mask]
+		seq := atomic.LoadUint32(&slot.seq)
+		diff := int32(seq - pos)
+		if diff == 0 {
+			if atomic.CompareAndSwapUint32(&r.head, pos, pos+1) {
+				slot.event = event
+				atomic.StoreUint32(&slot.seq, pos+1)
+				atomic.AddUint32(&r.pushed, 1)
+				r.wake.Signal()
+				return true
+			}
+		} else if diff < 0 {
+			//the consumer hasnt caught up
+			atomic.AddUint32(&r.dropped, 1)
+			return false
+		}
+		//someone else got this slot first, try the next one
+	}
+}
+
+//Takes the oldest event out of the ring without blocking. Safe to call from an ISR.
+//go:nosplit
+func (r *IRQ_ring) TryRecv() (IRQ_event, bool) {
+	for {
+		pos := atomic.LoadUint32(&r.tail)
+		slot := &r.slots[pos&r.mask]
+		seq := atomic.LoadUint32(&slot.seq)
+		diff := int32(seq - (pos + 1))
+		if diff == 0 {
+			if atomic.CompareAndSwapUint32(&r.tail, pos, pos+1) {
+				event := slot.event
+				atomic.StoreUint32(&slot.seq, pos+r.mask+1)
+				return event, true
+			}
+		} else if diff < 0 {
+			//empty, or a producer is still filling this slot
+			return IRQ_event{}, false
+		}
+	}
+}
+
+//Parks the calling goroutine until an event arrives
+func (r *IRQ_ring) Recv() IRQ_event {
+	for {
+		if event, ok := r.TryRecv(); ok {
+			//pushes only signal once, so pass it on to the next Recv
+			if r.Len() != 0 {
+				r.wake.Signal()
+			}
+			return event
+		}
+		r.wake.Wait()
+	}
+}
+
+//Starts a goroutine which moves events from the ring into a channel with the given capacity.
+//Events taken with Recv or TryRecv never show up on the channel.
+func (r *IRQ_ring) Chan(capacity int) <-chan IRQ_event {
+	out := make(chan IRQ_event, capacity)
+	go func() {
+		for {
+			out <- r.Recv()
+		}
+	}()
+	return out
+}
+
+//how many events are waiting to be read
+func (r *IRQ_ring) Len() uint32 {
+	return atomic.LoadUint32(&r.head) - atomic.LoadUint32(&r.tail)
+}
+
+//how many events made it into the ring since it was made
+func (r *IRQ_ring) Pushed() uint32 {
+	return atomic.LoadUint32(&r.pushed)
+}
+
+//how many events were thrown away because the ring was full
+func (r *IRQ_ring) Dropped() uint32 {
+	return atomic.LoadUint32(&r.dropped)
+}
@@ -0,0 +1,105 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package embedded
+
+import "errors"
+import "runtime"
+
+/*
+* Inter-core mailboxes.
+* Every cpu gets an IRQ_ring. Posting a message pushes it into the ring of the destination cpu
+* and fires a software generated interrupt at it. The destination either handles the message
+* in its ISR (if Mailbox_init got a handler) or leaves it for a goroutine calling Mailbox_recv,
+* which can be running on any cpu.
+ */
+
+const (
+	MAX_CPUS         = 4
+	MAILBOX_SGI      = 1
+	MAILBOX_PRIORITY = 0x80
+)
+
+//runs in IRQ mode on the receiving cpu, so it must be nosplit and must not block or allocate
+type Mailbox_handler func(from uint32, msg uint32)
+
+var mailboxes [MAX_CPUS]*IRQ_ring
+var mailbox_handler Mailbox_handler
+
+//Makes a mailbox that holds size messages for every cpu and hooks MAILBOX_SGI.
+//If handler is nil the messages wait for Mailbox_recv.
+//The SGI priority registers are banked per cpu, so the priority only gets set for the calling cpu.
+//The rest keep their reset value, which is the highest priority.
+func Mailbox_init(size uint32, handler Mailbox_handler) {
+	for i := range mailboxes {
+		mailboxes[i] = MakeIRQring(size)
+	}
+	mailbox_handler = handler
+	Register_interrupt(MAILBOX_SGI, 0, MAILBOX_PRIORITY, mailbox_isr, nil)
+}
+
+//Sends msg to cpu and interrupts it. Returns false if its mailbox is full.
+//This is nosplit so ISRs can post too.
+//go:nosplit
+func Mailbox_post(cpu uint32, msg uint32) bool {
+	if cpu >= MAX_CPUS || mailboxes[cpu] == nil {
+		return false
+	}
+	from := uint32(runtime.Cpunum())
+	if !mailboxes[cpu].Push(IRQ_event{from, msg}) {
+		return false
+	}
+	runtime.DMB()
+	Sgi(MAILBOX_SGI, 1<<cpu)
+	return true
+}
+
+//Sends msg to every cpu except the caller
+//go:nosplit
+func Mailbox_broadcast(msg uint32) {
+	self := uint32(runtime.Cpunum())
+	for cpu := uint32(0); cpu < MAX_CPUS; cpu++ {
+		if cpu != self {
+			Mailbox_post(cpu, msg)
+		}
+	}
+}
+
+//Blocks until there is a message for cpu. Source is the sender and Value is the message.
+//Only the handler from Mailbox_init runs on the receiving cpu. Mailbox_recv just drains cpu's mailbox
+//from whatever cpu the calling goroutine happens to be on, so use a handler for work that has to happen there.
+func Mailbox_recv(cpu uint32) (IRQ_event, error) {
+	if cpu >= MAX_CPUS {
+		return IRQ_event{}, errors.New("mailbox: no such cpu")
+	}
+	if mailboxes[cpu] == nil {
+		return IRQ_event{}, errors.New("mailbox: Mailbox_init has not been called")
+	}
+	return mailboxes[cpu].Recv(), nil
+}
+
+//how many messages to cpu were lost because its mailbox was full
+func Mailbox_dropped(cpu uint32) uint32 {
+	if cpu >= MAX_CPUS || mailboxes[cpu] == nil {
+		return 0
+	}
+	return mailboxes[cpu].Dropped()
+}
+
+//go:nosplit
+//go:nowritebarrierec
+func mailbox_isr(irqnum uint32) {
+	handler := mailbox_handler
+	if handler == nil {
+		return
+	}
+	cpu := uint32(runtime.Cpunum())
+	for {
+		event, ok := mailboxes[cpu].TryRecv()
+		if !ok {
+			return
+		}
+		handler(event.Source, event.Value)
+	}
+}
@@ -10,21 +10,30 @@ type ADC_reading struct {
 }
 
 type MCP3008_controller struct {
-	spi SPI_periph
+	spi *SPI_device
 }
 
-func MakeMCP3008(spi SPI_periph) *MCP3008_controller {
-	//32bit frames in mode 0
-	spi.Begin(0, 10, 24, 0)
-	return &MCP3008_controller{spi}
+//The MCP3008 is on chip select channel of spi. Other devices can share the bus.
+func MakeMCP3008(spi *SPI_periph, channel uint32) *MCP3008_controller {
+	//25bit frames in mode 0, at the ~58kHz this always ran at
+	dev, err := spi.Device(SPI_MODE0, 58600, 25, channel)
+	if err != nil {
+		panic("mcp3008: " + err.Error())
+	}
+	return &MCP3008_controller{dev}
 }
 
-func (mcp *MCP3008_controller) Read(channel uint8) ADC_reading {
+//fails if the bus cant be had, like when it is a slave
+func (mcp *MCP3008_controller) Read(channel uint8) (ADC_reading, error) {
 	//stuff gets shifted out in reverse
 	channel = channel & 0x7
 	command := BitReverse32(uint32(0x3<<3|channel) << 12)
-	result := float32(mcp.spi.Exchange(command) & 0x3ff)
-	return ADC_reading{channel, (result * 5.0) / 1024.0}
+	raw, err := mcp.spi.Exchange(command)
+	if err != nil {
+		return ADC_reading{}, err
+	}
+	result := float32(raw & 0x3ff)
+	return ADC_reading{channel, (result * 5.0) / 1024.0}, nil
 }
 
 //from the internet
@@ -7,20 +7,24 @@ package embedded
 //import "fmt"
 
 type MCP4922_controller struct {
-	spi SPI_periph
+	spi *SPI_device
 }
 
-func MakeMCP4922(spi SPI_periph) MCP4922_controller {
+//The MCP4922 is on chip select channel of spi. Other devices can share the bus.
+func MakeMCP4922(spi *SPI_periph, channel uint32) MCP4922_controller {
 	//16bit frames in mode 0
-	//spi.Begin(0, 10, 15, 0)
-	spi.Begin(0, 4, 15, 0)
-	return MCP4922_controller{spi}
+	dev, err := spi.Device(SPI_MODE0, 3750000, 16, channel)
+	if err != nil {
+		panic("mcp4922: " + err.Error())
+	}
+	return MCP4922_controller{dev}
 }
 
-func (m MCP4922_controller) Write(data uint16, channel uint8) {
+//fails if the bus cant be had, like when it is a slave
+func (m MCP4922_controller) Write(data uint16, channel uint8) error {
 	channel &= 0x1
 	data &= 0xFFF
 	out := (uint32(channel) << 15) | (uint32(1) << 14) | (uint32(1) << 13) | (uint32(1) << 12) | uint32(data)
 	//fmt.Printf("sending 0x%x\n", out)
-	m.spi.Send(out)
+	return m.spi.Send(out)
 }
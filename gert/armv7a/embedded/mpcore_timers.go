@@ -0,0 +1,222 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package embedded
+
+import "unsafe"
+import "errors"
+import "time"
+
+/*
+* Timers inside the Cortex-A9 MPCore, next to the GIC.
+* The global timer is one 64bit counter that every cpu sees.
+* The private timer and watchdog are banked: every cpu has its own at the same address,
+* so the functions for them set up whichever cpu happens to run them. Call them from code
+* that is known to run on the cpu you want, like a Mailbox_handler, and check runtime.Cpunum().
+* Their handlers are per cpu too (see Register_private_interrupt), so every cpu can run its own.
+* All of them tick at PERIPHCLK_HZ before their prescaler.
+* Section 4 of the Cortex-A9 MPCore TRM
+ */
+
+//private peripheral interrupts
+const (
+	GLOBAL_TIMER_IRQ      = 27
+	PRIVATE_TIMER_IRQ     = 29
+	PRIVATE_WATCHDOG_IRQ  = 30
+	MPCORE_TIMER_PRIORITY = 0x40
+)
+
+type global_timer_regs struct {
+	counter_lo    uint32
+	counter_hi    uint32
+	control       uint32
+	status        uint32
+	comparator_lo uint32
+	comparator_hi uint32
+	autoincrement uint32
+}
+
+type private_timer_regs struct {
+	load    uint32
+	counter uint32
+	control uint32
+	status  uint32
+	_       [4]uint32
+	//the watchdog starts at 0x20
+	wd_load    uint32
+	wd_counter uint32
+	wd_control uint32
+	wd_status  uint32
+	wd_reset   uint32
+	wd_disable uint32
+}
+
+var global_timer *global_timer_regs = (*global_timer_regs)(unsafe.Pointer(uintptr(MPCOREBASE + 0x200)))
+var private_timer *private_timer_regs = (*private_timer_regs)(unsafe.Pointer(uintptr(MPCOREBASE + 0x600)))
+
+//Starts the global timer if it isnt running yet
+func Global_timer_start() {
+	if global_timer.control&0x1 == 0 {
+		global_timer.control |= 0x1
+	}
+}
+
+//The two halves cant be read at once, so read hi until it stops changing under lo
+//go:nosplit
+func Global_timer_read() uint64 {
+	for {
+		hi := global_timer.counter_hi
+		lo := global_timer.counter_lo
+		if global_timer.counter_hi == hi {
+			return (uint64(hi) << 32) | uint64(lo)
+		}
+	}
+}
+
+//Moves the global timer to ticks. The counter can only be written while the timer is stopped,
+//so it loses the few ticks that takes.
+func Global_timer_write(ticks uint64) {
+	control := global_timer.control
+	global_timer.control = control &^ 0x1
+	global_timer.counter_lo = uint32(ticks)
+	global_timer.counter_hi = uint32(ticks >> 32)
+	global_timer.control = control | 0x1
+}
+
+//just the low half, for timing short things
+//go:nosplit
+func global_timer_read_lo() uint32 {
+	return global_timer.counter_lo
+}
+
+//Interrupts the calling cpu when the global timer reaches deadline, and then every
+//period ticks after that if period is not 0. The comparator is banked so every cpu can have its own.
+func Global_timer_set_compare(deadline uint64, period uint32, handler Interrupt_handler) {
+	Global_timer_start()
+	//turn off the comparator while we change it
+	global_timer.control &= ^uint32(0xE)
+	global_timer.status = 0x1
+	global_timer.comparator_lo = uint32(deadline)
+	global_timer.comparator_hi = uint32(deadline >> 32)
+	global_timer.autoincrement = period
+	Register_private_interrupt(GLOBAL_TIMER_IRQ, MPCORE_TIMER_PRIORITY, handler, global_timer_clear)
+	control := uint32(0x2 | 0x4)
+	if period != 0 {
+		control |= 0x8
+	}
+	global_timer.control |= control
+}
+
+func Global_timer_cancel_compare() {
+	global_timer.control &= ^uint32(0xE)
+	global_timer.status = 0x1
+}
+
+//go:nosplit
+func global_timer_clear() {
+	global_timer.status = 0x1
+}
+
+//splits ticks of PERIPHCLK into an 8bit prescaler and a 32bit count
+func mpcore_timer_divide(period time.Duration) (uint32, uint32, error) {
+	if period <= 0 {
+		return 0, 0, errors.New("timer period must be positive")
+	}
+	ticks := (uint64(period)/1000000000)*PERIPHCLK_HZ + ((uint64(period)%1000000000)*PERIPHCLK_HZ)/1000000000
+	if ticks == 0 {
+		return 0, 0, errors.New("timer period is shorter than one clock")
+	}
+	prescale := (ticks + 0xFFFFFFFF) / 0x100000000
+	if prescale > 256 {
+		return 0, 0, errors.New("timer period too long")
+	}
+	return uint32(prescale - 1), uint32(ticks/prescale - 1), nil
+}
+
+//Starts this cpu's private timer and runs handler on this cpu every period
+func Private_timer_begin(period time.Duration, handler Interrupt_handler) error {
+	prescale, load, err := mpcore_timer_divide(period)
+	if err != nil {
+		return err
+	}
+	private_timer.control = 0
+	private_timer.status = 0x1
+	private_timer.load = load
+	Register_private_interrupt(PRIVATE_TIMER_IRQ, MPCORE_TIMER_PRIORITY, handler, private_timer_clear)
+	//enable, auto reload and interrupt
+	private_timer.control = (prescale << 8) | 0x7
+	return nil
+}
+
+func Private_timer_stop() {
+	private_timer.control = 0
+	private_timer.status = 0x1
+}
+
+//go:nosplit
+func private_timer_clear() {
+	private_timer.status = 0x1
+}
+
+//Starts this cpu's watchdog. If reset is true the cpu gets reset when it runs out,
+//otherwise it just interrupts this cpu with handler and reloads.
+//Once it is in reset mode only Private_watchdog_stop or a reset gets it out.
+func Private_watchdog_begin(timeout time.Duration, reset bool, handler Interrupt_handler) error {
+	prescale, load, err := mpcore_timer_divide(timeout)
+	if err != nil {
+		return err
+	}
+	Private_watchdog_stop()
+	private_timer.wd_load = load
+	if reset {
+		//enable and watchdog mode
+		private_timer.wd_control = (prescale << 8) | 0x9
+		return nil
+	}
+	Register_private_interrupt(PRIVATE_WATCHDOG_IRQ, MPCORE_TIMER_PRIORITY, handler, private_watchdog_clear)
+	//enable, auto reload and interrupt
+	private_timer.wd_control = (prescale << 8) | 0x7
+	return nil
+}
+
+//Starts this cpu's watchdog count over by writing the load register again
+//go:nosplit
+func Private_watchdog_kick() {
+	load := private_timer.wd_load
+	private_timer.wd_load = load
+}
+
+//Takes the watchdog out of watchdog mode with the magic sequence and stops it
+func Private_watchdog_stop() {
+	private_timer.wd_disable = 0x12345678
+	private_timer.wd_disable = 0x87654321
+	private_timer.wd_control = 0
+	private_timer.wd_status = 0x1
+}
+
+//true if the last reset of this cpu came from its watchdog
+func Private_watchdog_caused_reset() bool {
+	return private_timer.wd_reset&0x1 != 0
+}
+
+//go:nosplit
+func private_watchdog_clear() {
+	private_timer.wd_status = 0x1
+}
+
+/*
+* The PMU cycle counter counts cpu clocks. It is per cpu too, and it is 32bits so it wraps every few seconds.
+ */
+
+const CPU_HZ = 792000000
+
+//Enables and resets the cycle counter of the calling cpu
+func Cycle_counter_init()
+
+//the cycle counter of the calling cpu
+func Cycles() uint32
+
+func Cycles2ns(cycles uint32) uint32 {
+	return uint32((uint64(cycles) * 1000000000) / CPU_HZ)
+}
@@ -0,0 +1,65 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package embedded
+
+import "runtime"
+
+/*
+* Nested interrupts.
+* Normally an ISR runs with IRQs masked in the cpu, so a slow handler delays everything else.
+* A handler marked with Set_preemptible instead runs with IRQs unmasked, and the GIC lets through
+* any interrupt whose group priority is higher (numerically lower) than the running one.
+* The group priority is the part of the 8bit priority above the binary point.
+* With binary point N, bits [7:N+1] are the group priority and bits [N:0] only order pending interrupts.
+*
+* Register contract:
+* The runtime's IRQ vector saves r0-r12, LR_irq and SPSR_irq on the IRQ stack before it calls the
+* callback, and it writes the EOI after the callback returns.
+* preempt_call then saves SPSR_irq, SP_sys and LR_sys, switches to system mode on the same stack and
+* unmasks IRQs for the duration of the handler. A nested IRQ gets its own stack frame below
+* PREEMPT_STACK_RESERVE bytes of the handler's stack, so preemptible handlers must not use more than that.
+* VFP/NEON registers are NOT saved by anyone, so preemptible handlers and every handler
+* that can preempt them must not use floating point.
+* The peripheral's clear function always runs with IRQs masked again.
+ */
+
+//keep in sync with preempt.s
+const PREEMPT_STACK_RESERVE = 2048
+
+var preemption_enabled bool
+var preemption_binary_point uint32
+
+//Turns on nested interrupts for handlers marked with Set_preemptible.
+//binary_point goes into the binary point register of whichever cpu dispatches a preemptible handler, every time it does,
+//since the register is banked and a cpu might not have seen the current value yet.
+func Enable_preemption(binary_point uint32) {
+	preemption_binary_point = binary_point & 0x7
+	preemption_enabled = true
+}
+
+func Disable_preemption() {
+	preemption_enabled = false
+}
+
+//Lets interrupts with a higher group priority preempt the handler for num.
+//Do this after Register_interrupt.
+func Set_preemptible(num uint32, preemptible bool) {
+	if num >= MAX_INTERRUPTS {
+		return
+	}
+	interrupt_table[num].preemptible = preemptible
+	if num >= FIRST_PPI && num <= LAST_PPI {
+		//and the calling cpu's own handler, if it has one
+		private_table[runtime.Cpunum()][num-FIRST_PPI].preemptible = preemptible
+	}
+}
+
+//the group priority that the GIC uses for preemption
+func Group_priority(priority uint8) uint8 {
+	return priority & uint8(0xFF<<(preemption_binary_point+1))
+}
+
+//runs handler(irqnum) in system mode with IRQs enabled, see preempt.s
+func preempt_call(handler Interrupt_handler, irqnum uint32)
@@ -0,0 +1,42 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+#include "textflag.h"
+
+// keep in sync with preempt.go
+#define PREEMPT_STACK_RESERVE 2048
+
+/*
+ * Frame layout (R13 is the IRQ stack pointer on entry):
+ *  4(R13) irqnum, the argument to the handler
+ *  8(R13) SPSR_irq
+ * 12(R13) SP_sys
+ * 16(R13) LR_sys
+ * The handler runs in system mode on the same stack. SP_irq is moved down by
+ * PREEMPT_STACK_RESERVE so that a nested IRQ does not land on top of the handler.
+ */
+TEXT ·preempt_call(SB), NOSPLIT, $20-8
+	MOVW handler+0(FP), R7
+	MOVW irqnum+4(FP), R0
+	MOVW R0, 4(R13)
+	WORD $0xe14f1000                // mrs r1, spsr
+	MOVW R1, 8(R13)
+	MOVW R13, R2
+	SUB  $PREEMPT_STACK_RESERVE, R13
+	WORD $0xf102001f                // cps #0x1f, system mode
+	MOVW R13, 12(R2)
+	MOVW R14, 16(R2)
+	MOVW R2, R13
+	WORD $0xf1080080                // cpsie i
+	MOVW 0(R7), R1
+	BL   (R1)
+	WORD $0xf10c0080                // cpsid i
+	MOVW R13, R2
+	MOVW 16(R2), R14
+	MOVW 12(R2), R13
+	WORD $0xf1020012                // cps #0x12, irq mode
+	MOVW R2, R13
+	MOVW 8(R13), R1
+	WORD $0xe16ff001                // msr spsr_cxsf, r1
+	RET
@@ -0,0 +1,132 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package embedded
+
+import "unsafe"
+import "errors"
+import "time"
+
+/*
+* The SNVS low power real time clock. It is a 47bit counter running off the 32.768kHz crystal
+* in the always-on domain, so it keeps wall-clock time across resets as long as the coin cell holds out.
+* The top 32 bits of the counter are seconds, so that is what the alarm compares against.
+* Section 57 of the iMX6 Quad Applications Manual
+ */
+
+const (
+	SNVS_IRQ = 51
+
+	SNVS_LPCR_SRTC_ENV = 1 << 0
+	SNVS_LPCR_LPTA_EN  = 1 << 1
+	SNVS_LPSR_LPTA     = 1 << 0
+	SNVS_RTC_HZ        = 32768
+)
+
+type SNVS_regs struct {
+	HPLR     uint32
+	HPCOMR   uint32
+	HPCR     uint32
+	_        [10]uint32
+	LPLR     uint32
+	LPCR     uint32
+	_        [4]uint32
+	LPSR     uint32
+	LPSRTCMR uint32
+	LPSRTCLR uint32
+	LPTAR    uint32
+}
+
+var snvs *SNVS_regs = (*SNVS_regs)(unsafe.Pointer(uintptr(0x20CC000)))
+
+//The counter halves can change between reads, so read until two reads agree
+func rtc_read_counter() uint64 {
+	for {
+		hi := snvs.LPSRTCMR & 0x7FFF
+		lo := snvs.LPSRTCLR
+		if hi == snvs.LPSRTCMR&0x7FFF && lo == snvs.LPSRTCLR {
+			return (uint64(hi) << 32) | uint64(lo)
+		}
+	}
+}
+
+//Turns on the RTC if it isnt counting yet. It keeps whatever time it had.
+func RTC_init() {
+	snvs.LPCR |= SNVS_LPCR_SRTC_ENV
+	for snvs.LPCR&SNVS_LPCR_SRTC_ENV == 0 {
+	}
+}
+
+//wall-clock time from the RTC
+func RTC_now() time.Time {
+	counter := rtc_read_counter()
+	sec := int64(counter / SNVS_RTC_HZ)
+	nsec := int64(((counter % SNVS_RTC_HZ) * 1000000000) / SNVS_RTC_HZ)
+	return time.Unix(sec, nsec).UTC()
+}
+
+//Sets the RTC to t. The counter has to be stopped while it is written.
+func RTC_set(t time.Time) error {
+	sec := t.Unix()
+	if sec < 0 || sec >= 1<<32 {
+		return errors.New("time does not fit in the RTC")
+	}
+	counter := (uint64(sec) << 15) | (uint64(t.Nanosecond()) * SNVS_RTC_HZ / 1000000000)
+	snvs.LPCR &= ^uint32(SNVS_LPCR_SRTC_ENV)
+	for snvs.LPCR&SNVS_LPCR_SRTC_ENV != 0 {
+	}
+	snvs.LPSRTCLR = uint32(counter)
+	snvs.LPSRTCMR = uint32(counter>>32) & 0x7FFF
+	RTC_init()
+	return nil
+}
+
+//Sets the clock the runtime reads for time.Now() to the RTC's time, so everything from then on
+//has a real date. The runtime's clock_gettime returns the global timer, and there is no settimeofday,
+//so this moves the global timer itself. Call it once at boot, right after pre_init:
+//the clock only ever moves forward, so an RTC that is behind the time since boot is an error,
+//and absolute Global_timer_set_compare deadlines set before this are off by the jump.
+//RTC_set after this doesnt change time.Now() until the next boot.
+func RTC_seed_time() error {
+	RTC_init()
+	Clock_init()
+	wall := RTC_now().UnixNano()
+	if wall <= Nanotime() {
+		return errors.New("the RTC is behind the time since boot, set it with RTC_set")
+	}
+	sec := uint64(wall / 1000000000)
+	nsec := uint64(wall % 1000000000)
+	Global_timer_write(sec*PERIPHCLK_HZ + (nsec*PERIPHCLK_HZ)/1000000000)
+	return nil
+}
+
+//Runs handler on cpunum once when the RTC gets to t, with one second resolution.
+//The handler runs in IRQ mode so it must be nosplit and must not block or allocate.
+func RTC_set_alarm(t time.Time, cpunum uint32, priority uint8, handler Interrupt_handler) error {
+	sec := t.Unix()
+	if sec < 0 || sec >= 1<<32 {
+		return errors.New("time does not fit in the RTC")
+	}
+	RTC_cancel_alarm()
+	snvs.LPTAR = uint32(sec)
+	snvs.LPSR = SNVS_LPSR_LPTA
+	Register_interrupt(SNVS_IRQ, cpunum, priority, handler, rtc_alarm_clear)
+	snvs.LPCR |= SNVS_LPCR_LPTA_EN
+	return nil
+}
+
+func RTC_cancel_alarm() {
+	//LPTAR can only be written while the alarm is off
+	snvs.LPCR &= ^uint32(SNVS_LPCR_LPTA_EN)
+	for snvs.LPCR&SNVS_LPCR_LPTA_EN != 0 {
+	}
+	snvs.LPSR = SNVS_LPSR_LPTA
+}
+
+//the alarm is one shot, so turn it off as well as clearing it
+//go:nosplit
+func rtc_alarm_clear() {
+	snvs.LPCR &= ^uint32(SNVS_LPCR_LPTA_EN)
+	snvs.LPSR = SNVS_LPSR_LPTA
+}
@@ -0,0 +1,373 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package embedded
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+/*
+* Just enough of the SDMA engine to move words between memory and a peripheral FIFO.
+* The SDMA is a little RISC core with scripts in its ROM. The ARM hands it a channel control block
+* per channel, each pointing at buffer descriptors, and loads a context (the script's registers)
+* into every channel through channel 0. A channel then runs its script every time its
+* peripheral raises the DMA event, moving watermark bytes at a time until its buffer is done.
+* Everything here uses the ROM scripts, so no firmware has to be loaded.
+* The SDMA sees physical addresses and doesnt look in the caches, so buffers have to be in
+* identity mapped memory and get cleaned and invalidated around every transfer.
+* A channel that finishes raises the SDMA interrupt, which wakes whoever waits on it, so
+* Interrupt_table_init has to come before anything uses the SDMA.
+ */
+
+const (
+	SDMA_CHANNELS = 32
+	SDMA_EVENTS   = 48
+
+	//iMX6Q ROM script entry points
+	SDMA_SCRIPT_APP_2_MCU = 683
+	SDMA_SCRIPT_MCU_2_APP = 747
+
+	//channel 0 commands
+	SDMA_C0_SETDM = 0x01
+
+	//buffer descriptor status
+	SDMA_BD_DONE = 0x01
+	SDMA_BD_WRAP = 0x02
+	SDMA_BD_INTR = 0x08
+	SDMA_BD_RROR = 0x10
+	SDMA_BD_LAST = 0x20
+	SDMA_BD_EXTD = 0x80
+
+	//buffer descriptor command for 32 bit peripheral accesses
+	SDMA_WIDTH_32 = 0
+
+	SDMA_PRIORITY = 3
+
+	SDMA_IRQ          = 34
+	SDMA_IRQ_PRIORITY = 0x80
+
+	L2_CACHE_LINE = 32
+)
+
+type SDMA_regs struct {
+	mc0ptr    uint32
+	intr      uint32
+	stop_stat uint32
+	hstart    uint32
+	evtovr    uint32
+	dspovr    uint32
+	hostovr   uint32
+	evtpend   uint32
+	_         uint32
+	reset     uint32
+	evterr    uint32
+	intrmask  uint32
+	psw       uint32
+	evterrdbg uint32
+	config    uint32
+	lock      uint32
+	once_enb  uint32
+	_         [6]uint32
+	chn0addr  uint32
+	_         [40]uint32
+	chnpri    [SDMA_CHANNELS]uint32
+	_         [32]uint32
+	chnenbl   [SDMA_EVENTS]uint32
+}
+
+//what the SDMA reads for every channel
+type sdma_ccb struct {
+	current_bd uint32
+	base_bd    uint32
+	status     uint32
+	_          uint32
+}
+
+type sdma_bd struct {
+	mode uint32 //count 15:0, status 23:16, command 31:24
+	addr uint32
+	ext  uint32
+}
+
+//the registers of a script, loaded into SDMA data memory through channel 0
+type sdma_context struct {
+	pc      uint32
+	spc     uint32
+	greg    [8]uint32
+	other   [14]uint32
+	scratch [8]uint32
+}
+
+//Everything the SDMA reads out of memory. It sits in one cache line aligned block so it can be cleaned in one go.
+type sdma_memory struct {
+	ccb     [SDMA_CHANNELS]sdma_ccb
+	bd      [SDMA_CHANNELS]sdma_bd
+	context sdma_context
+}
+
+//An SDMA channel that runs one script for one peripheral event
+type sdma_channel struct {
+	num       uint32
+	script    uint32
+	event     uint32
+	fifo      uint32
+	watermark uint32
+}
+
+var sdma = ((*SDMA_regs)(unsafe.Pointer(uintptr(0x20EC000))))
+var ccm_ccgr5 = ((*uint32)(unsafe.Pointer(uintptr(0x20C407C))))
+var pl310 = ((*[0x400]uint32)(unsafe.Pointer(uintptr(0xA02000))))
+
+var sdma_lock sync.Mutex
+var sdma_started bool
+var sdma_next uint32 = 1
+var sdma_block []byte
+var sdma_mem *sdma_memory
+
+//the channels whose interrupt came since their last start, and a Wakeup for each
+var sdma_done uint32
+var sdma_wake [SDMA_CHANNELS]Wakeup
+
+//Makes a byte slice whose start and end are on cache lines, so invalidating it cant hit anything else
+func Dma_alloc(size int) []byte {
+	size = (size + L2_CACHE_LINE - 1) &^ (L2_CACHE_LINE - 1)
+	buf := make([]byte, size+L2_CACHE_LINE)
+	off := int(-uintptr(unsafe.Pointer(&buf[0])) & (L2_CACHE_LINE - 1))
+	return buf[off : off+size : off+size]
+}
+
+func l1_clean_range(start, end uint32)
+func l1_invalidate_range(start, end uint32)
+
+func l2_enabled() bool {
+	return pl310[0x100/4]&1 != 0
+}
+
+//pl310 line operations take physical addresses, which are the same as ours
+func l2_range(start, end uint32, op uint32) {
+	if !l2_enabled() {
+		return
+	}
+	for a := start &^ (L2_CACHE_LINE - 1); a < end; a += L2_CACHE_LINE {
+		pl310[op/4] = a
+	}
+	pl310[0x730/4] = 0
+}
+
+//Writes b back to memory so a DMA read sees it
+func Dma_clean(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	start := uint32(uintptr(unsafe.Pointer(&b[0])))
+	end := start + uint32(len(b))
+	l1_clean_range(start, end)
+	l2_range(start, end, 0x7B0)
+}
+
+//Makes the next reads of b come from memory, after a DMA wrote it
+func Dma_invalidate(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	start := uint32(uintptr(unsafe.Pointer(&b[0])))
+	end := start + uint32(len(b))
+	//L2 first, so L1 cant refill from a stale L2 line
+	l2_range(start, end, 0x7F0)
+	l1_invalidate_range(start, end)
+}
+
+func sdma_phys(p unsafe.Pointer) uint32 {
+	return uint32(uintptr(p))
+}
+
+//sdma_lock is held
+func sdma_init() {
+	if sdma_started {
+		return
+	}
+	//ungate the SDMA clock
+	*ccm_ccgr5 |= 0x3 << 6
+	Clock_init()
+
+	sdma_block = Dma_alloc(int(unsafe.Sizeof(sdma_memory{})))
+	sdma_mem = (*sdma_memory)(unsafe.Pointer(&sdma_block[0]))
+
+	sdma.mc0ptr = 0
+	for i := range sdma.chnenbl {
+		sdma.chnenbl[i] = 0
+	}
+	for i := range sdma.chnpri {
+		sdma.chnpri[i] = 0
+	}
+	sdma.intr = 0xFFFFFFFF
+	Register_interrupt(SDMA_IRQ, 0, SDMA_IRQ_PRIORITY, sdma_isr, nil)
+
+	//channel 0 is the one the ARM runs commands on
+	sdma_mem.ccb[0].base_bd = sdma_phys(unsafe.Pointer(&sdma_mem.bd[0]))
+	sdma_mem.ccb[0].current_bd = sdma_mem.ccb[0].base_bd
+	sdma.evtovr |= 1
+	sdma.hostovr &^= 1
+	sdma.dspovr |= 1
+	sdma.chn0addr = 0x4050
+	sdma.config = 0
+	Dma_clean(sdma_block)
+	sdma.mc0ptr = sdma_phys(unsafe.Pointer(&sdma_mem.ccb[0]))
+	sdma.chnpri[0] = 7
+	sdma_started = true
+}
+
+//go:nosplit
+func sdma_done_update(clear, set uint32) {
+	for {
+		old := atomic.LoadUint32(&sdma_done)
+		if atomic.CompareAndSwapUint32(&sdma_done, old, (old&^clear)|set) {
+			return
+		}
+	}
+}
+
+//INTR stays set until it is written back, which also ends the interrupt
+//go:nosplit
+//go:nowritebarrierec
+func sdma_isr(irqnum uint32) {
+	bits := sdma.intr
+	sdma.intr = bits
+	sdma_done_update(0, bits)
+	for num := uint32(0); num < SDMA_CHANNELS; num++ {
+		if bits&(1<<num) != 0 {
+			sdma_wake[num].Signal()
+		}
+	}
+}
+
+//Parks until a channel finishes its buffer. Returns false if it took longer than timeout.
+func sdma_wait(num uint32, timeout time.Duration) bool {
+	bit := uint32(1) << num
+	deadline := Nanotime() + int64(timeout)
+	for atomic.LoadUint32(&sdma_done)&bit == 0 {
+		left := deadline - Nanotime()
+		if left > 0 && sdma_wake[num].Wait_timeout(time.Duration(left)) {
+			continue
+		}
+		//it might have finished just as we gave up
+		if atomic.LoadUint32(&sdma_done)&bit != 0 {
+			break
+		}
+		sdma.stop_stat = bit
+		return false
+	}
+	sdma_done_update(bit, 0)
+	return true
+}
+
+//Loads c's script registers through channel 0. sdma_lock is held.
+func (c *sdma_channel) load() error {
+	ctx := &sdma_mem.context
+	*ctx = sdma_context{}
+	ctx.pc = c.script
+	if c.event < 32 {
+		ctx.greg[1] = 1 << c.event
+	} else {
+		ctx.greg[0] = 1 << (c.event - 32)
+	}
+	ctx.greg[6] = c.fifo
+	ctx.greg[7] = c.watermark
+
+	bd := &sdma_mem.bd[0]
+	words := uint32(unsafe.Sizeof(*ctx) / 4)
+	bd.mode = words | (SDMA_BD_DONE|SDMA_BD_WRAP|SDMA_BD_EXTD)<<16 | SDMA_C0_SETDM<<24
+	bd.addr = sdma_phys(unsafe.Pointer(ctx))
+	//every channel's context lives at 2048 + 32 words * channel in SDMA data memory
+	bd.ext = 2048 + words*c.num
+	Dma_clean(sdma_block)
+	sdma_done_update(1, 0)
+	sdma.hstart = 1
+	if !sdma_wait(0, 100*time.Millisecond) {
+		return errors.New("sdma: channel 0 never finished loading a context")
+	}
+	return nil
+}
+
+//Makes a channel that runs script whenever the peripheral raises event.
+//fifo is the address of the peripheral's data register, and watermark how many bytes the peripheral
+//wants moved every time it raises the event.
+func sdma_request(script, event, fifo, watermark uint32) (*sdma_channel, error) {
+	sdma_lock.Lock()
+	defer sdma_lock.Unlock()
+	sdma_init()
+	if sdma_next >= SDMA_CHANNELS {
+		return nil, errors.New("sdma: out of channels")
+	}
+	if event >= SDMA_EVENTS {
+		return nil, errors.New("sdma: bad event")
+	}
+	c := &sdma_channel{num: sdma_next, script: script, event: event, fifo: fifo, watermark: watermark}
+	sdma_next++
+	bit := uint32(1) << c.num
+	//driven by its event, not by the ARM
+	sdma.evtovr &^= bit
+	sdma.hostovr &^= bit
+	sdma.dspovr |= bit
+	sdma.chnenbl[event] |= bit
+	sdma.chnpri[c.num] = SDMA_PRIORITY
+	sdma_mem.ccb[c.num].base_bd = sdma_phys(unsafe.Pointer(&sdma_mem.bd[c.num]))
+	sdma_mem.ccb[c.num].current_bd = sdma_mem.ccb[c.num].base_bd
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+//Changes how many bytes go per event, which means loading the context again
+func (c *sdma_channel) set_watermark(watermark uint32) error {
+	if c.watermark == watermark {
+		return nil
+	}
+	sdma_lock.Lock()
+	defer sdma_lock.Unlock()
+	c.watermark = watermark
+	return c.load()
+}
+
+//Points the channel at buf and lets it go. The buffer has to be cleaned or invalidated already.
+func (c *sdma_channel) start(buf []byte) {
+	sdma_lock.Lock()
+	bd := &sdma_mem.bd[c.num]
+	bd.mode = uint32(len(buf)) | (SDMA_BD_DONE|SDMA_BD_WRAP|SDMA_BD_EXTD|SDMA_BD_INTR|SDMA_BD_LAST)<<16 | SDMA_WIDTH_32<<24
+	bd.addr = sdma_phys(unsafe.Pointer(&buf[0]))
+	bd.ext = 0
+	sdma_mem.ccb[c.num].current_bd = sdma_mem.ccb[c.num].base_bd
+	Dma_clean(sdma_block)
+	sdma.intr = 1 << c.num
+	sdma_done_update(1<<c.num, 0)
+	sdma.hstart = 1 << c.num
+	sdma_lock.Unlock()
+}
+
+//Blocks the calling goroutine until the channel is done with its buffer
+func (c *sdma_channel) wait(timeout time.Duration) error {
+	if !sdma_wait(c.num, timeout) {
+		return errors.New("sdma: transfer timed out")
+	}
+	sdma_lock.Lock()
+	defer sdma_lock.Unlock()
+	Dma_invalidate(sdma_block)
+	if (sdma_mem.bd[c.num].mode>>16)&SDMA_BD_RROR != 0 {
+		return errors.New("sdma: transfer error")
+	}
+	return nil
+}
+
+//stops a channel that is still going
+func (c *sdma_channel) stop() {
+	sdma.stop_stat = 1 << c.num
+	sdma.intr = 1 << c.num
+	sdma_done_update(1<<c.num, 0)
+}
@@ -0,0 +1,38 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+#include "textflag.h"
+
+// func l1_clean_range(start, end uint32)
+// writes back every L1 D-cache line in [start, end) to the point of coherency
+TEXT ·l1_clean_range(SB), NOSPLIT, $0-8
+	MOVW start+0(FP), R0
+	MOVW end+4(FP), R1
+	BIC  $31, R0
+clean:
+	CMP  R1, R0
+	B.HS clean_done
+	WORD $0xee070f3a     // mcr p15, 0, r0, c7, c10, 1 (DCCMVAC)
+	ADD  $32, R0
+	B    clean
+clean_done:
+	WORD $0xf57ff04f     // dsb
+	RET
+
+// func l1_invalidate_range(start, end uint32)
+// throws away every L1 D-cache line in [start, end), writing back the dirty ones first
+// so whatever shares a line with the range survives. The next read comes from memory.
+TEXT ·l1_invalidate_range(SB), NOSPLIT, $0-8
+	MOVW start+0(FP), R0
+	MOVW end+4(FP), R1
+	BIC  $31, R0
+inval:
+	CMP  R1, R0
+	B.HS inval_done
+	WORD $0xee070f3e     // mcr p15, 0, r0, c7, c14, 1 (DCCIMVAC)
+	ADD  $32, R0
+	B    inval
+inval_done:
+	WORD $0xf57ff04f     // dsb
+	RET
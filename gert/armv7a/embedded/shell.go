@@ -0,0 +1,454 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package embedded
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+/*
+* A small command shell for poking at a running board over a serial port.
+* It understands enough VT100 for arrow keys, home/end, delete and the usual emacs control keys,
+* and it keeps a history you can scroll through with up and down.
+* Give it a Buffered_UART so that waiting for a key doesnt burn a cpu:
+*
+*	console := embedded.MakeBufferedUART(embedded.WB_DEFAULT_UART, 256, 0, 0xA0)
+*	sh := embedded.MakeShell(console, "gert> ")
+*	sh.Register("hi", "say hi", func(sh *embedded.Shell, args []string) error {
+*		fmt.Fprintf(sh, "hi\n")
+*		return nil
+*	})
+*	go sh.Run()
+ */
+
+const SHELL_HISTORY = 32
+
+//args[0] is the name of the command. Write the output to sh, which turns \n into \r\n.
+type Shell_func func(sh *Shell, args []string) error
+
+type shell_command struct {
+	help string
+	run  Shell_func
+}
+
+type Shell struct {
+	sync.Mutex
+	rw       io.ReadWriter
+	prompt   string
+	commands map[string]shell_command
+	pins     map[string]GPIO_pin
+	history  []string
+	skiplf   bool
+	lastc    byte
+}
+
+//Makes a shell with the built in commands and the JP4 pins of the wandboard
+func MakeShell(rw io.ReadWriter, prompt string) *Shell {
+	sh := &Shell{rw: rw, prompt: prompt, commands: map[string]shell_command{}, pins: map[string]GPIO_pin{}}
+	for _, pin := range []GPIO_pin{WB_JP4_4, WB_JP4_6, WB_JP4_8, WB_JP4_10, WB_JP4_12, WB_JP4_14} {
+		sh.AddPin(pin)
+	}
+	sh.register_builtins()
+	return sh
+}
+
+//Adds or replaces a command
+func (sh *Shell) Register(name, help string, run Shell_func) {
+	sh.Lock()
+	sh.commands[name] = shell_command{help, run}
+	sh.Unlock()
+}
+
+//Lets the gpio command use pin by its name
+func (sh *Shell) AddPin(pin GPIO_pin) {
+	sh.Lock()
+	sh.pins[pin.name] = pin
+	sh.Unlock()
+}
+
+//Writes p to the serial port with every \n turned into \r\n
+func (sh *Shell) Write(p []byte) (int, error) {
+	start := 0
+	for i, c := range p {
+		if c == '\n' && sh.lastc != '\r' {
+			n, err := sh.rw.Write(p[start:i])
+			if err != nil {
+				return start + n, err
+			}
+			//everything before the \n is out, the \n itself goes with the next write
+			start = i
+			if _, err := sh.rw.Write([]byte("\r")); err != nil {
+				return start, err
+			}
+		}
+		sh.lastc = c
+	}
+	n, err := sh.rw.Write(p[start:])
+	if err != nil {
+		return start + n, err
+	}
+	return len(p), nil
+}
+
+//Reads and runs commands until the serial port returns an error
+func (sh *Shell) Run() error {
+	for {
+		line, err := sh.readline()
+		if err != nil {
+			return err
+		}
+		sh.Exec(line)
+	}
+}
+
+//Runs one line as if it was typed in
+func (sh *Shell) Exec(line string) {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return
+	}
+	sh.Lock()
+	cmd, ok := sh.commands[args[0]]
+	sh.Unlock()
+	if !ok {
+		fmt.Fprintf(sh, "%s: unknown command, try help\n", args[0])
+		return
+	}
+	if err := cmd.run(sh, args); err != nil {
+		fmt.Fprintf(sh, "%s: %v\n", args[0], err)
+	}
+}
+
+func (sh *Shell) readbyte() (byte, error) {
+	var c [1]byte
+	for {
+		n, err := sh.rw.Read(c[:])
+		if n == 1 {
+			return c[0], nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+//puts the prompt and line back on the screen and the cursor where it belongs
+func (sh *Shell) redraw(line []byte, cursor int) {
+	out := "\r" + sh.prompt + string(line) + "\x1b[K"
+	if cursor < len(line) {
+		out += fmt.Sprintf("\x1b[%dD", len(line)-cursor)
+	}
+	io.WriteString(sh.rw, out)
+}
+
+func (sh *Shell) readline() (string, error) {
+	var line []byte
+	cursor := 0
+	hist := len(sh.history)
+	sh.redraw(line, cursor)
+	for {
+		c, err := sh.readbyte()
+		if err != nil {
+			return "", err
+		}
+		//a terminal that sends \r\n should only end one line
+		if c == '\n' && sh.skiplf {
+			sh.skiplf = false
+			continue
+		}
+		sh.skiplf = c == '\r'
+		switch c {
+		case '\r', '\n':
+			io.WriteString(sh.rw, "\r\n")
+			sh.remember(string(line))
+			return string(line), nil
+		case 0x03: //ctrl-c
+			io.WriteString(sh.rw, "^C\r\n")
+			return "", nil
+		case 0x7F, 0x08: //backspace
+			if cursor > 0 {
+				line = append(line[:cursor-1], line[cursor:]...)
+				cursor--
+			}
+		case 0x01: //ctrl-a
+			cursor = 0
+		case 0x05: //ctrl-e
+			cursor = len(line)
+		case 0x0B: //ctrl-k
+			line = line[:cursor]
+		case 0x15: //ctrl-u
+			line = append([]byte{}, line[cursor:]...)
+			cursor = 0
+		case 0x1B:
+			//VT100 escapes look like ESC [ A or ESC O A, and delete is ESC [ 3 ~
+			if c, err = sh.readbyte(); err != nil {
+				return "", err
+			}
+			if c != '[' && c != 'O' {
+				break
+			}
+			if c, err = sh.readbyte(); err != nil {
+				return "", err
+			}
+			switch c {
+			case 'A':
+				if hist > 0 {
+					hist--
+					line = []byte(sh.history[hist])
+					cursor = len(line)
+				}
+			case 'B':
+				if hist < len(sh.history) {
+					hist++
+					line = nil
+					if hist < len(sh.history) {
+						line = []byte(sh.history[hist])
+					}
+					cursor = len(line)
+				}
+			case 'C':
+				if cursor < len(line) {
+					cursor++
+				}
+			case 'D':
+				if cursor > 0 {
+					cursor--
+				}
+			case 'H':
+				cursor = 0
+			case 'F':
+				cursor = len(line)
+			case '3':
+				if c, err = sh.readbyte(); err != nil {
+					return "", err
+				}
+				if c == '~' && cursor < len(line) {
+					line = append(line[:cursor], line[cursor+1:]...)
+				}
+			}
+		default:
+			if c >= 0x20 && c < 0x7F {
+				line = append(line, 0)
+				copy(line[cursor+1:], line[cursor:])
+				line[cursor] = c
+				cursor++
+			}
+		}
+		sh.redraw(line, cursor)
+	}
+}
+
+func (sh *Shell) remember(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if n := len(sh.history); n > 0 && sh.history[n-1] == line {
+		return
+	}
+	sh.history = append(sh.history, line)
+	if len(sh.history) > SHELL_HISTORY {
+		sh.history = sh.history[1:]
+	}
+}
+
+func shell_parse(s string) (uint32, error) {
+	v, err := strconv.ParseUint(s, 0, 32)
+	return uint32(v), err
+}
+
+/*
+* Built in commands.
+* peek, poke and md touch whatever address you give them. An address with nothing behind it
+* takes a data abort, so stick to RAM and the peripherals in the memory map.
+ */
+
+func (sh *Shell) register_builtins() {
+	sh.Register("help", "list the commands", shell_help)
+	sh.Register("history", "list the last commands", shell_history)
+	sh.Register("gpio", "gpio <pin> [in|0|1]: read a pin, or make it an input or drive it", shell_gpio)
+	sh.Register("peek", "peek <addr> [count]: read 32bit registers", shell_peek)
+	sh.Register("poke", "poke <addr> <value>: write a 32bit register", shell_poke)
+	sh.Register("md", "md <addr> [bytes]: hex dump memory", shell_md)
+	sh.Register("irqs", "irqs [stats|reset]: list interrupts or their counters", shell_irqs)
+	sh.Register("ps", "show goroutine and cpu counts", shell_ps)
+	sh.Register("mem", "show memory stats", shell_mem)
+	sh.Register("gc", "run the garbage collector", shell_gc)
+	if port, ok := sh.rw.(*Buffered_UART); ok {
+		sh.Register("load", "load [reset|jump]: receive a new bootloader.elf from tools/gertload and boot it", Chainload_command(port))
+	}
+}
+
+func shell_help(sh *Shell, args []string) error {
+	sh.Lock()
+	lines := make([]string, 0, len(sh.commands))
+	for name, cmd := range sh.commands {
+		lines = append(lines, fmt.Sprintf("%-10s %s\n", name, cmd.help))
+	}
+	sh.Unlock()
+	sort.Strings(lines)
+	for _, line := range lines {
+		io.WriteString(sh, line)
+	}
+	return nil
+}
+
+func shell_history(sh *Shell, args []string) error {
+	for i, line := range sh.history {
+		fmt.Fprintf(sh, "%3d %s\n", i, line)
+	}
+	return nil
+}
+
+func shell_gpio(sh *Shell, args []string) error {
+	if len(args) < 2 {
+		sh.Lock()
+		for name := range sh.pins {
+			fmt.Fprintf(sh, "%s ", name)
+		}
+		sh.Unlock()
+		fmt.Fprintf(sh, "\n")
+		return nil
+	}
+	sh.Lock()
+	pin, ok := sh.pins[args[1]]
+	sh.Unlock()
+	if !ok {
+		return errors.New("no pin called " + args[1])
+	}
+	if len(args) == 2 {
+		fmt.Fprintf(sh, "%s = %d\n", pin.name, pin.Read())
+		return nil
+	}
+	switch args[2] {
+	case "in":
+		pin.SetInput()
+	case "0", "1":
+		pin.SetOutput()
+		pin.Write(args[2][0] - '0')
+	default:
+		return errors.New("pin can only be in, 0 or 1")
+	}
+	return nil
+}
+
+func shell_peek(sh *Shell, args []string) error {
+	if len(args) < 2 {
+		return errors.New("need an address")
+	}
+	addr, err := shell_parse(args[1])
+	if err != nil {
+		return err
+	}
+	count := uint32(1)
+	if len(args) > 2 {
+		if count, err = shell_parse(args[2]); err != nil {
+			return err
+		}
+	}
+	addr &^= 3
+	for i := uint32(0); i < count; i++ {
+		reg := (*uint32)(unsafe.Pointer(uintptr(addr + 4*i)))
+		fmt.Fprintf(sh, "0x%08x: 0x%08x\n", addr+4*i, *reg)
+	}
+	return nil
+}
+
+func shell_poke(sh *Shell, args []string) error {
+	if len(args) < 3 {
+		return errors.New("need an address and a value")
+	}
+	addr, err := shell_parse(args[1])
+	if err != nil {
+		return err
+	}
+	val, err := shell_parse(args[2])
+	if err != nil {
+		return err
+	}
+	reg := (*uint32)(unsafe.Pointer(uintptr(addr &^ 3)))
+	*reg = val
+	return nil
+}
+
+//reads a word at a time so it is safe on peripherals that dont like byte reads
+func shell_md(sh *Shell, args []string) error {
+	if len(args) < 2 {
+		return errors.New("need an address")
+	}
+	addr, err := shell_parse(args[1])
+	if err != nil {
+		return err
+	}
+	length := uint32(64)
+	if len(args) > 2 {
+		if length, err = shell_parse(args[2]); err != nil {
+			return err
+		}
+	}
+	addr &^= 0xF
+	for line := uint32(0); line < length; line += 16 {
+		var b [16]byte
+		for i := uint32(0); i < 16; i += 4 {
+			w := *(*uint32)(unsafe.Pointer(uintptr(addr + line + i)))
+			b[i], b[i+1], b[i+2], b[i+3] = byte(w), byte(w>>8), byte(w>>16), byte(w>>24)
+		}
+		text := make([]byte, 16)
+		for i, c := range b {
+			text[i] = '.'
+			if c >= 0x20 && c < 0x7F {
+				text[i] = c
+			}
+		}
+		fmt.Fprintf(sh, "0x%08x: % x  %s\n", addr+line, b[:], text)
+	}
+	return nil
+}
+
+func shell_irqs(sh *Shell, args []string) error {
+	if len(args) < 2 {
+		Fprint_interrupt_state(sh)
+		return nil
+	}
+	switch args[1] {
+	case "stats":
+		if !interrupt_stats_enabled {
+			fmt.Fprintf(sh, "counting starts now, run it again later\n")
+			Enable_interrupt_stats()
+			return nil
+		}
+		Fprint_interrupt_stats(sh)
+	case "reset":
+		Reset_interrupt_stats()
+	default:
+		return errors.New("try irqs, irqs stats or irqs reset")
+	}
+	return nil
+}
+
+func shell_ps(sh *Shell, args []string) error {
+	fmt.Fprintf(sh, "goroutines %d\ncpus       %d\nthis cpu   %d\n", runtime.NumGoroutine(), runtime.GOMAXPROCS(0), runtime.Cpunum())
+	return nil
+}
+
+func shell_mem(sh *Shell, args []string) error {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	fmt.Fprintf(sh, "alloc        %d\ntotal alloc  %d\nsys          %d\nheap objects %d\nmallocs      %d\nfrees        %d\ngc runs      %d\ngc pause(ns) %d\n",
+		m.Alloc, m.TotalAlloc, m.Sys, m.HeapObjects, m.Mallocs, m.Frees, m.NumGC, m.PauseTotalNs)
+	return nil
+}
+
+func shell_gc(sh *Shell, args []string) error {
+	runtime.GC()
+	return nil
+}
@@ -5,9 +5,14 @@
 package embedded
 
 import (
-	"fmt"
+	"errors"
+	"sync"
+	"unsafe"
 )
 
+//what the master side gets while the bus is a slave, see spi_slave.go
+var spi_err_slave = errors.New("spi: the bus is a slave until Stop")
+
 type SPI_regs struct {
 	rxdata  uint32
 	txdata  uint32
@@ -22,110 +27,444 @@ type SPI_regs struct {
 	msgdata uint32
 }
 
-//either mosi, miso, sclk, or cs
+//either mosi, miso, sclk, or cs. Inputs also have to be picked in the daisy chain register.
 type SPI_pin struct {
-	name   string
-	alt    uint8
-	muxctl *uint32
-	padctl *uint32
+	name     string
+	alt      uint8
+	muxctl   *uint32
+	padctl   *uint32
+	daisy    *uint32
+	daisyval uint32
 }
 
-type SPI_periph struct {
-	mosi       SPI_pin
-	miso       SPI_pin
-	sclk       SPI_pin
-	cs         []SPI_pin
-	regs       *SPI_regs
+//Everything Begin works out, so a device can put it back on the bus
+type spi_settings struct {
 	mode       uint32
 	frequency  uint32
 	datalength uint32
+	channel    uint32
+	control    uint32
+	config     uint32
 }
 
-//SPI has 3 types of modes which affect the polarity of the clock and the resting state of the data signals
-//data length is how many bits each SPI frame contains. 7,8,16 are common amounts
+//One ECSPI and its pins. Begin, Send and Exchange use it directly, which is fine when only one
+//chip is on the bus. When there are more, get an SPI_device for each of them from Device.
+type SPI_periph struct {
+	mosi   SPI_pin
+	miso   SPI_pin
+	sclk   SPI_pin
+	cs     []SPI_pin
+	regs   *SPI_regs
+	lock   sync.Mutex
+	pinned bool
+	busy   bool
+	cur    spi_settings
 
-//the imx6 can support up to 2^12 bits in a single frame!
-func (spi *SPI_periph) Begin(mode, freq, datalength, channel uint32) {
-	//put the gpio pins on push/pull mode with their appropriate alternate functions
-	*spi.mosi.muxctl = makeGPIOmuxconfig(spi.mosi.alt)
-	*spi.mosi.padctl = makeGPIOpadconfig(1, PULLDOWN_100K, 1, 1, 0, SPEED_FAST, DRIVE_260R, SLEW_FAST)
+	//see spi_async.go
+	irq       uint32
+	rx_event  uint32
+	tx_event  uint32
+	irq_on    bool
+	xfer      spi_xfer
+	xfer_wake Wakeup
+	dma_min   int
+	dma_tx    *sdma_channel
+	dma_rx    *sdma_channel
+	dma_buf   []byte
 
-	*spi.miso.muxctl = makeGPIOmuxconfig(spi.miso.alt)
-	*spi.miso.padctl = makeGPIOpadconfig(1, PULLDOWN_100K, 1, 1, 0, SPEED_FAST, DRIVE_260R, SLEW_FAST)
+	//see spi_slave.go
+	slave *SPI_slave
+}
 
-	*spi.sclk.muxctl = makeGPIOmuxconfig(spi.sclk.alt)
-	*spi.sclk.padctl = makeGPIOpadconfig(1, PULLDOWN_100K, 1, 1, 0, SPEED_FAST, DRIVE_260R, SLEW_FAST)
+//A chip on a shared SPI bus with its own mode, speed, data length and chip select.
+//Every transaction locks the bus and puts this device's settings back on it if another device changed them.
+type SPI_device struct {
+	bus      *SPI_periph
+	settings spi_settings
+}
 
-	for i := 0; i < len(spi.cs); i++ {
-		*spi.cs[i].muxctl = makeGPIOmuxconfig(spi.cs[i].alt)
-		*spi.cs[i].padctl = makeGPIOpadconfig(1, PULLDOWN_100K, 1, 1, 0, SPEED_FAST, DRIVE_260R, SLEW_FAST)
+const (
+	//mode is CPOL<<1 | CPHA
+	SPI_CPHA  = 1 << 0
+	SPI_CPOL  = 1 << 1
+	SPI_MODE0 = 0
+	SPI_MODE1 = SPI_CPHA
+	SPI_MODE2 = SPI_CPOL
+	SPI_MODE3 = SPI_CPOL | SPI_CPHA
+
+	SPI_CHANNELS      = 4
+	SPI_MAX_BURST     = 4096
+	SPI_PLL3_60M      = 60000000
+	SPI_MAX_PREDIV    = 16
+	SPI_MAX_POSTDIV   = 15
+	SPI_CONTROL_EN    = 1 << 0
+	SPI_CONTROL_XCH   = 1 << 2
+	SPI_CONTROL_SMC   = 1 << 3
+	SPI_CONTROL_BURST = 0xFFF << 20
+	SPI_FIFO_WORDS    = 64
+	SPI_STATUS_TE     = 1 << 0
+	SPI_STATUS_TF     = 1 << 2
+	SPI_STATUS_RR     = 1 << 3
+	SPI_STATUS_TC     = 1 << 7
+)
+
+//CCM_CSCDR2 has the divider from pll3's 60MHz output to the ECSPI root clock
+var ccm_cscdr2 = ((*uint32)(unsafe.Pointer(uintptr(0x20C4038))))
+
+//The clock all the ECSPIs divide their SCLK from, in Hz
+func SPI_root_clock() uint32 {
+	podf := (*ccm_cscdr2 >> 19) & 0x3F
+	return SPI_PLL3_60M / (podf + 1)
+}
+
+//Picks the pre divider (1-16) and post divider (2^0-2^15) that get SCLK as close to hz as
+//possible without going over. Returns the dividers and the SCLK they make.
+func spi_dividers(root, hz uint32) (uint32, uint32, uint32, error) {
+	if hz == 0 || hz > root {
+		return 0, 0, 0, errors.New("spi: sclk has to be between 1Hz and the root clock")
+	}
+	div := (root + hz - 1) / hz
+	//the smallest post divider that works leaves the pre divider the most resolution
+	for post := uint32(0); post <= SPI_MAX_POSTDIV; post++ {
+		pre := (div + (1 << post) - 1) >> post
+		if pre <= SPI_MAX_PREDIV {
+			return pre - 1, post, root / (pre << post), nil
+		}
 	}
+	return 0, 0, 0, errors.New("spi: sclk too slow")
+}
 
-	//ungate the module clock
-	//Put 0x3F into CCM_CCGR1
-	//CCM_CCGR1 := ((*uint32)(unsafe.Pointer(uintptr(0x20C406C))))
-	//*CCM_CCGR1 |= 0x3F
+func (p *SPI_pin) configure() {
+	*p.muxctl = makeGPIOmuxconfig(p.alt)
+	*p.padctl = makeGPIOpadconfig(1, PULLDOWN_100K, 1, 1, 0, SPEED_FAST, DRIVE_260R, SLEW_FAST)
+	if p.daisy != nil {
+		*p.daisy = p.daisyval
+	}
+}
 
-	//configure the SPI registers for the freq, mode, and datalength
-	spi.regs.control = 0
-	spi.regs.control |= datalength << 20
-	if channel > 1 {
-		fmt.Printf("bad spi channel, abort\n")
-		return
+//SPI has 4 modes which set the polarity of the clock (SPI_CPOL) and which edge the data is sampled on (SPI_CPHA).
+//hz is the SCLK to aim for, Begin gets as close as it can without going over.
+//data length is how many bits each SPI frame contains. 8,16,32 are common amounts
+
+//the imx6 can support up to 2^12 bits in a single frame!
+func (spi *SPI_periph) Begin(mode, hz, datalength, channel uint32) error {
+	s, err := spi.settings(mode, hz, datalength, channel)
+	if err != nil {
+		return err
+	}
+	spi.lock.Lock()
+	defer spi.lock.Unlock()
+	if spi.slave != nil {
+		return spi_err_slave
 	}
-	spi.regs.control |= channel << 18
+	spi.pins()
+	spi.apply(s)
+	return nil
+}
 
-	//use a post divider
-	spi.regs.control |= freq << 8
+//Makes a handle for the chip on channel. Nothing changes on the bus until it is used.
+func (spi *SPI_periph) Device(mode, hz, datalength, channel uint32) (*SPI_device, error) {
+	s, err := spi.settings(mode, hz, datalength, channel)
+	if err != nil {
+		return nil, err
+	}
+	spi.lock.Lock()
+	spi.pins()
+	spi.lock.Unlock()
+	return &SPI_device{spi, s}, nil
+}
 
-	//everyone is in master mode
-	spi.regs.control |= 0xF << 4
+//works out the control and config registers for a configuration
+func (spi *SPI_periph) settings(mode, hz, datalength, channel uint32) (spi_settings, error) {
+	if mode > SPI_MODE3 {
+		return spi_settings{}, errors.New("spi: mode has to be 0-3")
+	}
+	if datalength == 0 || datalength > SPI_MAX_BURST {
+		return spi_settings{}, errors.New("spi: data length has to be 1-4096 bits")
+	}
+	if channel >= SPI_CHANNELS || channel >= uint32(len(spi.cs)) {
+		return spi_settings{}, errors.New("spi: no chip select for that channel")
+	}
+	pre, post, actual, err := spi_dividers(SPI_root_clock(), hz)
+	if err != nil {
+		return spi_settings{}, err
+	}
+	s := spi_settings{mode: mode, frequency: actual, datalength: datalength, channel: channel}
 
-	spi.regs.control |= 1 << 3
+	//configure the SPI registers for the freq, mode, and datalength
+	s.control |= (datalength - 1) << 20
+	s.control |= channel << 18
+	s.control |= pre << 12
+	s.control |= post << 8
 
-	spi.regs.config = 0
-	if mode == 0 {
-	} else if mode == 3 {
-		spi.regs.config |= 0xFF
-	} else {
-		fmt.Printf("unsupported mode %d. abort\n", mode)
+	//everyone is in master mode, Begin_slave is the other way
+	s.control |= 0xF << 4
+
+	s.control |= SPI_CONTROL_SMC
+
+	if mode&SPI_CPHA != 0 {
+		s.config |= 1 << channel
+	}
+	if mode&SPI_CPOL != 0 {
+		//sclk idles high too
+		s.config |= 1<<(4+channel) | 1<<(20+channel)
 	}
-	spi.regs.config |= 0xF << 12
+	s.config |= 0xF << 12
 
 	//toggle cs on every burst
-	spi.regs.config |= 0xF << 8
+	s.config |= 0xF << 8
+	return s, nil
+}
 
-	spi.regs.intr = 0
+//put the gpio pins on push/pull mode with their appropriate alternate functions
+func (spi *SPI_periph) pins() {
+	if spi.pinned {
+		return
+	}
+	spi.mosi.configure()
+	spi.miso.configure()
+	spi.sclk.configure()
+	for i := 0; i < len(spi.cs); i++ {
+		spi.cs[i].configure()
+	}
 
-	spi.regs.control |= 1
+	//ungate the module clock
+	//Put 0x3F into CCM_CCGR1
+	//CCM_CCGR1 := ((*uint32)(unsafe.Pointer(uintptr(0x20C406C))))
+	//*CCM_CCGR1 |= 0x3F
+	spi.pinned = true
+}
 
+//Waits for whatever Send left in the TX FIFO to go out and throws away what came back for it
+func (spi *SPI_periph) idle() {
+	if spi.regs.control&SPI_CONTROL_EN == 0 {
+		return
+	}
+	for spi.busy && spi.regs.status&SPI_STATUS_TC == 0 {
+	}
+	spi.busy = false
+	for spi.regs.status&SPI_STATUS_RR != 0 {
+		_ = spi.regs.rxdata
+	}
+}
+
+//Reprograms the ECSPI once the bus is quiet. Turning it off on the way also empties the FIFOs.
+//While EN is clear the ECSPI is held in reset and ignores writes to everything but control,
+//so it has to be back on before config and the rest go in.
+func (spi *SPI_periph) apply(s spi_settings) {
+	spi.idle()
+	spi.regs.control = s.control
+	spi.regs.control = s.control | SPI_CONTROL_EN
+	spi.regs.config = s.config
+	spi.regs.intr = 0
 	spi.regs.status = 0xff
+	spi.cur = s
+}
 
-	spi.mode = mode
-	spi.frequency = freq
-	spi.datalength = datalength
+//the SCLK Begin ended up with, in Hz
+func (spi *SPI_periph) Frequency() uint32 {
+	return spi.cur.frequency
+}
+
+func (spi *SPI_periph) mask() uint32 {
+	if spi.cur.datalength >= 32 {
+		return 0xFFFFFFFF
+	}
+	return uint32(1<<spi.cur.datalength) - uint32(1)
 }
 
 //assumes datalength < 32bits
-func (spi *SPI_periph) Send(data uint32) {
+func (spi *SPI_periph) Send(data uint32) error {
 	//mask := uint32(1<<spi.datalength) - uint32(1)
 	//data = data & mask
+	if spi.slave != nil {
+		return spi_err_slave
+	}
 
 	//wait for tx fifo to have space
-	//for spi.regs.status&0x2 != 0 {
-	//}
+	for spi.regs.status&SPI_STATUS_TF != 0 {
+	}
 
+	//transfer complete comes back once this and everything before it is out
+	spi.regs.status = SPI_STATUS_TC
+	spi.busy = true
 	spi.regs.txdata = data
+	return nil
 }
 
 //assumes datalength < 32 bits
-func (spi *SPI_periph) Exchange(data uint32) uint32 {
-	mask := uint32(1<<spi.datalength) - uint32(1)
-	data = data & mask
+func (spi *SPI_periph) Exchange(data uint32) (uint32, error) {
+	if spi.slave != nil {
+		return 0, spi_err_slave
+	}
+	spi.idle()
+	data = data & spi.mask()
+	if spi.irq_on {
+		return spi.exchange_irq(data), nil
+	}
 	spi.regs.txdata = data
 
 	//wait for rx fifo to get data
-	for spi.regs.status&(0x1<<3) == 0 {
+	for spi.regs.status&SPI_STATUS_RR == 0 {
+	}
+	return spi.regs.rxdata, nil
+}
+
+//Sends tx and receives into rx at the same time, with chip select held for up to SPI_MAX_BURST/8 bytes.
+//Either one can be nil, a nil tx sends zeros. Longer transfers go out as several bursts and chip select
+//goes away for a moment between them. The data length from Begin doesnt matter here.
+//After Use_interrupts or Use_DMA the calling goroutine yields while the burst goes.
+func (spi *SPI_periph) Transfer(tx, rx []byte) error {
+	n := len(tx)
+	if tx == nil {
+		n = len(rx)
+	} else if rx != nil && len(rx) != n {
+		return errors.New("spi: tx and rx have to be the same length")
+	}
+	if spi.slave != nil {
+		return spi_err_slave
+	}
+	if spi.regs.control&SPI_CONTROL_EN == 0 {
+		return errors.New("spi: not started")
+	}
+	spi.idle()
+	for off := 0; off < n; off += SPI_MAX_BURST / 8 {
+		end := off + SPI_MAX_BURST/8
+		if end > n {
+			end = n
+		}
+		var t, r []byte
+		if tx != nil {
+			t = tx[off:end]
+		}
+		if rx != nil {
+			r = rx[off:end]
+		}
+		if err := spi.burst_any(t, r, end-off); err != nil {
+			return err
+		}
+	}
+	//back to what Send and Exchange expect
+	spi.regs.control = spi.cur.control | SPI_CONTROL_EN
+	return nil
+}
+
+//The words of a burst. When the burst isnt a whole number of words,
+//the first word has the leftover bytes in its low end. Every word goes out msb first.
+func spi_words(n int) int {
+	return (n + 3) / 4
+}
+
+//go:nosplit
+func spi_word_bytes(n, word int) (int, int) {
+	first := n % 4
+	if first == 0 {
+		first = 4
+	}
+	if word == 0 {
+		return 0, first
+	}
+	start := first + (word-1)*4
+	return start, start + 4
+}
+
+//go:nosplit
+func spi_pack(tx []byte, n, word int) uint32 {
+	if tx == nil {
+		return 0
+	}
+	start, end := spi_word_bytes(n, word)
+	v := uint32(0)
+	for _, b := range tx[start:end] {
+		v = v<<8 | uint32(b)
+	}
+	return v
+}
+
+//go:nosplit
+func spi_unpack(rx []byte, n, word int, v uint32) {
+	if rx == nil {
+		return
+	}
+	start, end := spi_word_bytes(n, word)
+	for i := end - 1; i >= start; i-- {
+		rx[i] = byte(v)
+		v >>= 8
+	}
+}
+
+//One burst of n bytes. The FIFO starts full and gets topped up while it goes, and RX is emptied as it
+//fills so it never overflows. XCH starts it once the FIFO is full, so it doesnt start and then run dry.
+func (spi *SPI_periph) burst(tx, rx []byte, n int) {
+	words := spi_words(n)
+	control := (spi.cur.control &^ (SPI_CONTROL_BURST | SPI_CONTROL_SMC)) | uint32(n*8-1)<<20 | SPI_CONTROL_EN
+	spi.regs.control = control
+	sent := 0
+	for sent < words && sent < SPI_FIFO_WORDS {
+		spi.regs.txdata = spi_pack(tx, n, sent)
+		sent++
+	}
+	spi.regs.control = control | SPI_CONTROL_XCH
+	received := 0
+	for received < words {
+		if sent < words && spi.regs.status&SPI_STATUS_TF == 0 {
+			spi.regs.txdata = spi_pack(tx, n, sent)
+			sent++
+		}
+		if spi.regs.status&SPI_STATUS_RR != 0 {
+			spi_unpack(rx, n, received, spi.regs.rxdata)
+			received++
+		}
+	}
+}
+
+//Takes the bus and puts this device's settings on it. Transactions do this themselves,
+//so only lock a device to keep other devices off the bus across several of them.
+//Fails while the bus is a slave, since a master on it would take the slave's words.
+func (d *SPI_device) Lock() error {
+	d.bus.lock.Lock()
+	if d.bus.slave != nil {
+		d.bus.lock.Unlock()
+		return spi_err_slave
+	}
+	if d.bus.cur != d.settings {
+		d.bus.apply(d.settings)
+	}
+	return nil
+}
+
+func (d *SPI_device) Unlock() {
+	d.bus.lock.Unlock()
+}
+
+//Send on this device's settings. Another device getting the bus waits for it to finish.
+func (d *SPI_device) Send(data uint32) error {
+	if err := d.Lock(); err != nil {
+		return err
+	}
+	defer d.Unlock()
+	return d.bus.Send(data)
+}
+
+//Exchange on this device's settings
+func (d *SPI_device) Exchange(data uint32) (uint32, error) {
+	if err := d.Lock(); err != nil {
+		return 0, err
+	}
+	defer d.Unlock()
+	return d.bus.Exchange(data)
+}
+
+//the SCLK this device runs at, in Hz
+func (d *SPI_device) Frequency() uint32 {
+	return d.settings.frequency
+}
+
+//Transfer on this device's settings
+func (d *SPI_device) Transfer(tx, rx []byte) error {
+	if err := d.Lock(); err != nil {
+		return err
 	}
-	return spi.regs.rxdata
+	defer d.Unlock()
+	return d.bus.Transfer(tx, rx)
 }
@@ -0,0 +1,244 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package embedded
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+/*
+* SPI transfers that dont keep a cpu spinning on the status register.
+* After Use_interrupts, Transfer and Exchange start the burst and the ECSPI interrupt keeps the
+* TX FIFO full and the RX FIFO empty (TX data request and RX data request/ready) while the
+* calling goroutine parks until the interrupt wakes it at the end.
+* After Use_DMA, transfers of at least min bytes go through two SDMA channels instead,
+* one feeding TXDATA and one emptying RXDATA, so the cpu only packs and unpacks the words.
+* The SDMA needs Interrupt_table_init too, its interrupt is how a transfer ends.
+ */
+
+const (
+	SPI_INTR_TDREN = 1 << 1
+	SPI_INTR_RREN  = 1 << 3
+	SPI_INTR_RDREN = 1 << 4
+
+	SPI_DMA_TEDEN = 1 << 7
+	SPI_DMA_RXDEN = 1 << 23
+
+	//half the FIFO, so there is always room for the next request's worth
+	SPI_WATERMARK = SPI_FIFO_WORDS / 2
+)
+
+//One burst in progress. n is 0 for a single Exchange word.
+type spi_xfer struct {
+	tx       []byte
+	rx       []byte
+	n        int
+	words    int
+	sent     int
+	received int
+	word     uint32
+	done     uint32
+}
+
+//go:nosplit
+func (x *spi_xfer) pack(word int) uint32 {
+	if x.n == 0 {
+		return x.word
+	}
+	return spi_pack(x.tx, x.n, word)
+}
+
+//go:nosplit
+func (x *spi_xfer) unpack(word int, v uint32) {
+	if x.n == 0 {
+		x.word = v
+		return
+	}
+	spi_unpack(x.rx, x.n, word, v)
+}
+
+//which interrupts the rest of the burst needs
+//go:nosplit
+func (x *spi_xfer) intr() uint32 {
+	intr := uint32(0)
+	if x.sent < x.words {
+		intr |= SPI_INTR_TDREN
+	}
+	//a whole watermark is still coming, or just the tail
+	if x.words-x.received > SPI_WATERMARK {
+		intr |= SPI_INTR_RDREN
+	} else {
+		intr |= SPI_INTR_RREN
+	}
+	return intr
+}
+
+//Routes the ECSPI interrupt to cpunum and makes Transfer and Exchange wait on it instead of spinning
+func (spi *SPI_periph) Use_interrupts(cpunum uint32, priority uint8) {
+	spi.lock.Lock()
+	defer spi.lock.Unlock()
+	spi.regs.intr = 0
+	Register_interrupt(spi.irq, cpunum, priority, spi.isr, nil)
+	spi.irq_on = true
+}
+
+//go:nosplit
+//go:nowritebarrierec
+func (spi *SPI_periph) isr(irqnum uint32) {
+	if slave := spi.slave; slave != nil {
+		slave.isr()
+		return
+	}
+	x := &spi.xfer
+	for x.received < x.words && spi.regs.status&SPI_STATUS_RR != 0 {
+		x.unpack(x.received, spi.regs.rxdata)
+		x.received++
+	}
+	for x.sent < x.words && spi.regs.status&SPI_STATUS_TF == 0 {
+		spi.regs.txdata = x.pack(x.sent)
+		x.sent++
+	}
+	if x.received == x.words {
+		spi.regs.intr = 0
+		atomic.StoreUint32(&x.done, 1)
+		spi.xfer_wake.Signal()
+		return
+	}
+	spi.regs.intr = x.intr()
+}
+
+//Starts the burst in spi.xfer and parks until the interrupt says it is done
+func (spi *SPI_periph) wait_irq(control uint32) {
+	x := &spi.xfer
+	for x.sent < x.words && x.sent < SPI_FIFO_WORDS {
+		spi.regs.txdata = x.pack(x.sent)
+		x.sent++
+	}
+	//RX data request comes with more than the threshold in the FIFO, TX data request with no more than it
+	spi.regs.dma = (SPI_WATERMARK-1)<<16 | SPI_WATERMARK
+	runtime.DMB()
+	spi.regs.control = control | SPI_CONTROL_XCH
+	spi.regs.intr = x.intr()
+	for atomic.LoadUint32(&x.done) == 0 {
+		spi.xfer_wake.Wait()
+	}
+	spi.regs.dma = 0
+}
+
+func (spi *SPI_periph) burst_irq(tx, rx []byte, n int) {
+	spi.xfer = spi_xfer{tx: tx, rx: rx, n: n, words: spi_words(n)}
+	control := (spi.cur.control &^ (SPI_CONTROL_BURST | SPI_CONTROL_SMC)) | uint32(n*8-1)<<20 | SPI_CONTROL_EN
+	spi.regs.control = control
+	spi.wait_irq(control)
+}
+
+func (spi *SPI_periph) exchange_irq(data uint32) uint32 {
+	spi.xfer = spi_xfer{words: 1, word: data}
+	control := (spi.cur.control &^ SPI_CONTROL_SMC) | SPI_CONTROL_EN
+	spi.regs.control = control
+	spi.wait_irq(control)
+	spi.regs.control = spi.cur.control | SPI_CONTROL_EN
+	return spi.xfer.word
+}
+
+//Sends transfers of at least min bytes through the SDMA. Only whole bursts of SPI_MAX_BURST/8
+//bytes or less go at a time, so the cpu is back for a moment between bursts.
+//Call Interrupt_table_init first.
+func (spi *SPI_periph) Use_DMA(min int) error {
+	spi.lock.Lock()
+	defer spi.lock.Unlock()
+	if spi.dma_tx == nil {
+		base := uint32(uintptr(unsafe.Pointer(spi.regs)))
+		tx, err := sdma_request(SDMA_SCRIPT_MCU_2_APP, spi.tx_event, base+4, SPI_WATERMARK*4)
+		if err != nil {
+			return err
+		}
+		rx, err := sdma_request(SDMA_SCRIPT_APP_2_MCU, spi.rx_event, base, SPI_WATERMARK*4)
+		if err != nil {
+			return err
+		}
+		spi.dma_tx = tx
+		spi.dma_rx = rx
+		spi.dma_buf = Dma_alloc(2 * SPI_MAX_BURST / 8)
+	}
+	if min < 1 {
+		min = 1
+	}
+	spi.dma_min = min
+	return nil
+}
+
+//the most words per DMA request that still divides the burst evenly
+func spi_watermark(words int) uint32 {
+	wml := SPI_WATERMARK
+	for words%wml != 0 {
+		wml >>= 1
+	}
+	return uint32(wml)
+}
+
+func (spi *SPI_periph) burst_dma(tx, rx []byte, n int) error {
+	words := spi_words(n)
+	txbuf := spi.dma_buf[:4*words]
+	rxbuf := spi.dma_buf[SPI_MAX_BURST/8 : SPI_MAX_BURST/8+4*words]
+	txwords := (*[SPI_MAX_BURST / 32]uint32)(unsafe.Pointer(&txbuf[0]))
+	rxwords := (*[SPI_MAX_BURST / 32]uint32)(unsafe.Pointer(&rxbuf[0]))
+	for i := 0; i < words; i++ {
+		txwords[i] = spi_pack(tx, n, i)
+	}
+	wml := spi_watermark(words)
+	if err := spi.dma_tx.set_watermark(wml * 4); err != nil {
+		return err
+	}
+	if err := spi.dma_rx.set_watermark(wml * 4); err != nil {
+		return err
+	}
+	Dma_clean(txbuf)
+	Dma_invalidate(rxbuf)
+
+	//SMC starts the burst as soon as the SDMA puts the first words in the TX FIFO
+	spi.regs.control = (spi.cur.control &^ SPI_CONTROL_BURST) | uint32(n*8-1)<<20 | SPI_CONTROL_EN
+	spi.dma_rx.start(rxbuf)
+	spi.dma_tx.start(txbuf)
+	spi.regs.dma = (wml-1)<<16 | SPI_DMA_RXDEN | wml | SPI_DMA_TEDEN
+
+	//every word comes back, so RX finishing means TX did too. Allow 10x the time the bits take.
+	timeout := 10*time.Duration(n*8)*time.Second/time.Duration(spi.cur.frequency) + 10*time.Millisecond
+	err := spi.dma_rx.wait(timeout)
+	if err == nil {
+		err = spi.dma_tx.wait(timeout)
+	}
+	spi.regs.dma = 0
+	if err != nil {
+		spi.dma_tx.stop()
+		spi.dma_rx.stop()
+		//turning it off and on empties the FIFOs, and loses config, so put it all back
+		spi.apply(spi.cur)
+		return err
+	}
+	Dma_invalidate(rxbuf)
+	if rx != nil {
+		for i := 0; i < words; i++ {
+			spi_unpack(rx, n, i, rxwords[i])
+		}
+	}
+	return nil
+}
+
+//picks how to move one burst
+func (spi *SPI_periph) burst_any(tx, rx []byte, n int) error {
+	switch {
+	case spi.dma_min > 0 && n >= spi.dma_min:
+		return spi.burst_dma(tx, rx, n)
+	case spi.irq_on:
+		spi.burst_irq(tx, rx, n)
+	default:
+		spi.burst(tx, rx, n)
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package embedded
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+* The ECSPI as the slave of some other chip's master. The master drives SCLK and chip select,
+* so nothing here starts a transfer. Every datalength bit word the master shifts in lands in the
+* RX FIFO and the interrupt moves it into an RX ring. At the same time the ECSPI shifts out the
+* word at the front of its TX FIFO, which the interrupt keeps topped up from a TX ring.
+* Words written before the master starts clocking are already sitting in the TX FIFO when it does.
+* If the master clocks faster than responses get written, it reads whatever the shift register had left.
+ */
+
+const (
+	SPI_STATUS_RO = 1 << 6
+)
+
+//what Read and Write get once Stop has been called
+var spi_err_stopped = errors.New("spi: the slave is stopped")
+
+//A word queue with one producer and one consumer, where either side can be an ISR
+type word_ring struct {
+	buf  []uint32
+	mask uint32
+	head uint32
+	tail uint32
+}
+
+func make_word_ring(size uint32) word_ring {
+	n := uint32(1)
+	for n < size {
+		n <<= 1
+	}
+	return word_ring{buf: make([]uint32, n), mask: n - 1}
+}
+
+//go:nosplit
+func (r *word_ring) put(w uint32) bool {
+	head := atomic.LoadUint32(&r.head)
+	if head-atomic.LoadUint32(&r.tail) > r.mask {
+		return false
+	}
+	r.buf[head&r.mask] = w
+	atomic.StoreUint32(&r.head, head+1)
+	return true
+}
+
+//go:nosplit
+func (r *word_ring) get() (uint32, bool) {
+	tail := atomic.LoadUint32(&r.tail)
+	if tail == atomic.LoadUint32(&r.head) {
+		return 0, false
+	}
+	w := r.buf[tail&r.mask]
+	atomic.StoreUint32(&r.tail, tail+1)
+	return w, true
+}
+
+//go:nosplit
+func (r *word_ring) len() uint32 {
+	return atomic.LoadUint32(&r.head) - atomic.LoadUint32(&r.tail)
+}
+
+type SPI_slave struct {
+	bus      *SPI_periph
+	rx       word_ring
+	tx       word_ring
+	rlock    sync.Mutex
+	wlock    sync.Mutex
+	dropped  uint32
+	overruns uint32
+	stopped  uint32
+	rx_wake  Wakeup
+	tx_wake  Wakeup
+}
+
+//Makes the ECSPI a slave on channel's chip select, which is active low. mode is the same as for Begin
+//and datalength is 1-32 bits. Both rings hold size words, rounded up to a power of 2, and the
+//interrupt goes to cpunum. Until Stop, Begin and the devices on the bus refuse to run it as a master.
+func (spi *SPI_periph) Begin_slave(mode, datalength, channel, size, cpunum uint32, priority uint8) (*SPI_slave, error) {
+	if mode > SPI_MODE3 {
+		return nil, errors.New("spi: mode has to be 0-3")
+	}
+	if datalength == 0 || datalength > 32 {
+		return nil, errors.New("spi: slave data length has to be 1-32 bits")
+	}
+	if channel >= SPI_CHANNELS || channel >= uint32(len(spi.cs)) {
+		return nil, errors.New("spi: no chip select for that channel")
+	}
+	s := spi_settings{mode: mode, datalength: datalength, channel: channel}
+
+	//channel mode stays 0 for a slave. SCLK comes from the master so the dividers dont matter,
+	//and every burst is one word so each one lands in the RX FIFO on its own.
+	s.control |= (datalength - 1) << 20
+	s.control |= channel << 18
+	if mode&SPI_CPHA != 0 {
+		s.config |= 1 << channel
+	}
+	if mode&SPI_CPOL != 0 {
+		s.config |= 1 << (4 + channel)
+	}
+
+	spi.lock.Lock()
+	defer spi.lock.Unlock()
+	if spi.slave != nil {
+		return nil, errors.New("spi: already a slave")
+	}
+	slave := &SPI_slave{bus: spi, rx: make_word_ring(size), tx: make_word_ring(size)}
+	spi.pins()
+	spi.idle()
+	//off to empty the FIFOs, then on before anything else, see apply
+	spi.regs.control = s.control
+	spi.regs.control = s.control | SPI_CONTROL_EN
+	spi.regs.config = s.config
+	spi.regs.intr = 0
+	//TX data request comes with no more than this many words left in the FIFO
+	spi.regs.dma = SPI_WATERMARK
+	spi.regs.status = 0xff
+	spi.cur = s
+	spi.slave = slave
+	runtime.DMB()
+	Register_interrupt(spi.irq, cpunum, priority, spi.isr, nil)
+	spi.regs.intr = SPI_INTR_RREN
+	return slave, nil
+}
+
+//Same as the Buffered_UART one: nothing else clears TDREN, and Write always sets it after filling the ring.
+//go:nosplit
+//go:nowritebarrierec
+func (s *SPI_slave) isr() {
+	regs := s.bus.regs
+	if regs.status&SPI_STATUS_RO != 0 {
+		regs.status = SPI_STATUS_RO
+		atomic.AddUint32(&s.overruns, 1)
+	}
+	received := false
+	for regs.status&SPI_STATUS_RR != 0 {
+		received = true
+		if !s.rx.put(regs.rxdata) {
+			atomic.AddUint32(&s.dropped, 1)
+		}
+	}
+	if received {
+		s.rx_wake.Signal()
+	}
+
+	if regs.intr&SPI_INTR_TDREN == 0 {
+		return
+	}
+	for regs.status&SPI_STATUS_TF == 0 {
+		w, ok := s.tx.get()
+		if !ok {
+			regs.intr &^= SPI_INTR_TDREN
+			runtime.DMB()
+			if s.tx.len() != 0 {
+				regs.intr |= SPI_INTR_TDREN
+			}
+			break
+		}
+		regs.txdata = w
+	}
+	s.tx_wake.Signal()
+}
+
+//Blocks until at least one word has arrived and then returns as many as fit in p.
+//Fails once the slave is stopped, waking up a Read that was blocked at the time.
+func (s *SPI_slave) Read(p []uint32) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	s.rlock.Lock()
+	defer s.rlock.Unlock()
+	for {
+		//Stop signals after setting stopped, so a signal missed here is still pending for Wait
+		if atomic.LoadUint32(&s.stopped) != 0 {
+			return 0, spi_err_stopped
+		}
+		if s.rx.len() != 0 {
+			break
+		}
+		s.rx_wake.Wait()
+	}
+	n := 0
+	for n < len(p) {
+		w, ok := s.rx.get()
+		if !ok {
+			break
+		}
+		p[n] = w
+		n++
+	}
+	return n, nil
+}
+
+//Queues p to go out the next times the master clocks the bus. Blocks until all of it is in the TX ring.
+//Fails once the slave is stopped and returns how many words made it into the ring before that.
+func (s *SPI_slave) Write(p []uint32) (int, error) {
+	mask := s.bus.mask()
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+	for i := 0; i < len(p); {
+		if s.tx.put(p[i] & mask) {
+			i++
+			continue
+		}
+		//full, so let the ISR move some into the FIFO
+		if !s.kick() {
+			return i, spi_err_stopped
+		}
+		s.tx_wake.Wait()
+	}
+	if !s.kick() {
+		return len(p), spi_err_stopped
+	}
+	return len(p), nil
+}
+
+//Turns on the TX interrupt, unless Stop already gave the bus back
+func (s *SPI_slave) kick() bool {
+	s.bus.lock.Lock()
+	defer s.bus.lock.Unlock()
+	if s.bus.slave != s {
+		return false
+	}
+	s.bus.regs.intr |= SPI_INTR_TDREN
+	return true
+}
+
+//calls f with every word that arrives until the slave is stopped
+func (s *SPI_slave) receive(f func(word uint32)) {
+	buf := make([]uint32, SPI_FIFO_WORDS)
+	for {
+		n, err := s.Read(buf)
+		if err != nil {
+			return
+		}
+		for _, w := range buf[:n] {
+			f(w)
+		}
+	}
+}
+
+//Starts a goroutine which calls f with every word that arrives, until Stop.
+//Words taken with Read never get to f.
+func (s *SPI_slave) On_receive(f func(word uint32)) {
+	go s.receive(f)
+}
+
+//Starts a goroutine which moves received words into a channel with the given capacity.
+//The channel gets closed after Stop. Words taken with Read never show up on the channel.
+func (s *SPI_slave) Chan(capacity int) <-chan uint32 {
+	out := make(chan uint32, capacity)
+	go func() {
+		s.receive(func(w uint32) {
+			out <- w
+		})
+		close(out)
+	}()
+	return out
+}
+
+//how many received words are waiting to be read
+func (s *SPI_slave) Buffered() int {
+	return int(s.rx.len())
+}
+
+//how many written words the master hasnt clocked out yet, not counting the TX FIFO
+func (s *SPI_slave) Queued() int {
+	return int(s.tx.len())
+}
+
+//how many received words were thrown away because nobody read the ring in time
+func (s *SPI_slave) Dropped() uint32 {
+	return atomic.LoadUint32(&s.dropped)
+}
+
+//how many times the RX FIFO filled up before the interrupt got to it
+func (s *SPI_slave) Overruns() uint32 {
+	return atomic.LoadUint32(&s.overruns)
+}
+
+//Turns the ECSPI off and gives the bus back, so Begin or a device can make it a master again.
+//Words still in the rings are thrown away. A Read or Write blocked on the slave fails, and
+//On_receive and Chan finish up.
+func (s *SPI_slave) Stop() {
+	spi := s.bus
+	spi.lock.Lock()
+	defer spi.lock.Unlock()
+	if spi.slave != s {
+		//already stopped, and the bus might belong to someone else by now
+		return
+	}
+	atomic.StoreUint32(&s.stopped, 1)
+	s.rx_wake.Signal()
+	s.tx_wake.Signal()
+	spi.regs.intr = 0
+	spi.regs.control = 0
+	spi.regs.dma = 0
+	if !spi.irq_on {
+		Unregister_interrupt(spi.irq)
+	}
+	spi.slave = nil
+	//so the next device puts its settings back
+	spi.cur = spi_settings{}
+}
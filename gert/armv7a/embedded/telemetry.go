@@ -0,0 +1,271 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package embedded
+
+import (
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"sync"
+)
+
+/*
+* Binary telemetry. Instead of fmt.Printf'ing values, register a struct type once and Send values of it.
+* Every message is a frame:
+*
+*	type u8 | seq u8 | Nanotime u64 | fields | crc16
+*
+* with everything little endian and the crc being the XMODEM one over the rest of the frame.
+* Frames are COBS encoded and end with a 0, so the host can start listening at any point
+* and a broken frame only costs that frame.
+* Type 0 describes the other types: their ids, names and fields. Those go out when a type is registered
+* and again every TELEMETRY_DESCRIBE_EVERY frames, so tools/gerttel can decode a stream without
+* knowing the program that sent it.
+ */
+
+const (
+	TELEMETRY_DESCRIBE       = 0
+	TELEMETRY_MAX_TYPES      = 255
+	TELEMETRY_MAX_FRAME      = 1024
+	TELEMETRY_DESCRIBE_EVERY = 256
+
+	TELEMETRY_BOOL = 1
+	TELEMETRY_I8   = 2
+	TELEMETRY_U8   = 3
+	TELEMETRY_I16  = 4
+	TELEMETRY_U16  = 5
+	TELEMETRY_I32  = 6
+	TELEMETRY_U32  = 7
+	TELEMETRY_I64  = 8
+	TELEMETRY_U64  = 9
+	TELEMETRY_F32  = 10
+	TELEMETRY_F64  = 11
+)
+
+var telemetry_kinds = map[reflect.Kind]uint8{
+	reflect.Bool:    TELEMETRY_BOOL,
+	reflect.Int8:    TELEMETRY_I8,
+	reflect.Uint8:   TELEMETRY_U8,
+	reflect.Int16:   TELEMETRY_I16,
+	reflect.Uint16:  TELEMETRY_U16,
+	reflect.Int32:   TELEMETRY_I32,
+	reflect.Uint32:  TELEMETRY_U32,
+	reflect.Int64:   TELEMETRY_I64,
+	reflect.Uint64:  TELEMETRY_U64,
+	reflect.Int:     TELEMETRY_I64,
+	reflect.Uint:    TELEMETRY_U64,
+	reflect.Float32: TELEMETRY_F32,
+	reflect.Float64: TELEMETRY_F64,
+}
+
+type Telemetry struct {
+	lock   sync.Mutex
+	w      io.Writer
+	types  []*Telemetry_type
+	seq    uint8
+	frames uint32
+	raw    []byte
+	cobs   []byte
+}
+
+//A registered message type. Send values of the struct type it was registered with.
+type Telemetry_type struct {
+	t     *Telemetry
+	id    uint8
+	name  string
+	typ   reflect.Type
+	kinds []uint8
+}
+
+//Sends frames to w, which can be a UART, a Buffered_UART or anything else.
+//Give it a port of its own, text printed into the stream shows up on the host as bad frames.
+func MakeTelemetry(w io.Writer) *Telemetry {
+	Clock_init()
+	return &Telemetry{
+		w:    w,
+		raw:  make([]byte, 0, TELEMETRY_MAX_FRAME),
+		cobs: make([]byte, 0, TELEMETRY_MAX_FRAME+TELEMETRY_MAX_FRAME/254+2),
+	}
+}
+
+//Registers the struct type of sample as message name. Its fields have to be
+//bools, sized ints, ints or floats, and they go out in order.
+func (t *Telemetry) Register(name string, sample interface{}) (*Telemetry_type, error) {
+	typ := reflect.TypeOf(sample)
+	if typ == nil || typ.Kind() != reflect.Struct {
+		return nil, errors.New("telemetry: messages have to be structs")
+	}
+	if len(name) > 255 {
+		return nil, errors.New("telemetry: name too long")
+	}
+	mt := &Telemetry_type{t: t, name: name, typ: typ}
+	size := 18
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		kind, ok := telemetry_kinds[f.Type.Kind()]
+		if !ok {
+			return nil, errors.New("telemetry: field " + f.Name + " is not a bool, int or float")
+		}
+		mt.kinds = append(mt.kinds, kind)
+		size += telemetry_size(kind)
+	}
+	if size > TELEMETRY_MAX_FRAME {
+		return nil, errors.New("telemetry: message too big")
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.types) >= TELEMETRY_MAX_TYPES {
+		return nil, errors.New("telemetry: too many types")
+	}
+	mt.id = uint8(len(t.types) + 1)
+	t.types = append(t.types, mt)
+	if err := t.describe(mt); err != nil {
+		return nil, err
+	}
+	return mt, nil
+}
+
+//Sends v, which has to be a value of (or pointer to) the registered struct type.
+//This uses reflection and a mutex, so dont call it from an ISR. Push into an IRQ_ring there instead.
+func (mt *Telemetry_type) Send(v interface{}) error {
+	val := reflect.ValueOf(v)
+	if val.Kind() == reflect.Ptr {
+		val = val.Elem()
+	}
+	if !val.IsValid() {
+		return errors.New("telemetry: " + mt.name + " sent nil")
+	}
+	if val.Type() != mt.typ {
+		return errors.New("telemetry: " + mt.name + " sent a " + val.Type().String())
+	}
+	t := mt.t
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.frames++
+	if t.frames%TELEMETRY_DESCRIBE_EVERY == 0 {
+		for _, other := range t.types {
+			if err := t.describe(other); err != nil {
+				return err
+			}
+		}
+	}
+	t.start(mt.id)
+	for i, kind := range mt.kinds {
+		f := val.Field(i)
+		switch kind {
+		case TELEMETRY_BOOL:
+			b := uint64(0)
+			if f.Bool() {
+				b = 1
+			}
+			t.put(b, 1)
+		case TELEMETRY_I8, TELEMETRY_I16, TELEMETRY_I32, TELEMETRY_I64:
+			t.put(uint64(f.Int()), telemetry_size(kind))
+		case TELEMETRY_U8, TELEMETRY_U16, TELEMETRY_U32, TELEMETRY_U64:
+			t.put(f.Uint(), telemetry_size(kind))
+		case TELEMETRY_F32:
+			t.put(uint64(math.Float32bits(float32(f.Float()))), 4)
+		case TELEMETRY_F64:
+			t.put(math.Float64bits(f.Float()), 8)
+		}
+	}
+	return t.finish()
+}
+
+//Sends the descriptions of every type again, for a host that just started listening
+func (t *Telemetry) Describe() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, mt := range t.types {
+		if err := t.describe(mt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func telemetry_size(kind uint8) int {
+	switch kind {
+	case TELEMETRY_BOOL, TELEMETRY_I8, TELEMETRY_U8:
+		return 1
+	case TELEMETRY_I16, TELEMETRY_U16:
+		return 2
+	case TELEMETRY_I32, TELEMETRY_U32, TELEMETRY_F32:
+		return 4
+	}
+	return 8
+}
+
+//id u8 | name len u8 | name | nfields u8 | then kind u8 | name len u8 | name for every field
+//t.lock is held
+func (t *Telemetry) describe(mt *Telemetry_type) error {
+	t.start(TELEMETRY_DESCRIBE)
+	t.put(uint64(mt.id), 1)
+	t.put_string(mt.name)
+	t.put(uint64(len(mt.kinds)), 1)
+	for i, kind := range mt.kinds {
+		t.put(uint64(kind), 1)
+		t.put_string(mt.typ.Field(i).Name)
+	}
+	if len(t.raw)+2 > TELEMETRY_MAX_FRAME {
+		t.raw = t.raw[:0]
+		return errors.New("telemetry: description of " + mt.name + " too big")
+	}
+	return t.finish()
+}
+
+func (t *Telemetry) start(id uint8) {
+	t.raw = t.raw[:0]
+	t.put(uint64(id), 1)
+	t.put(uint64(t.seq), 1)
+	t.seq++
+	t.put(uint64(Nanotime()), 8)
+}
+
+func (t *Telemetry) put(v uint64, size int) {
+	for i := 0; i < size; i++ {
+		t.raw = append(t.raw, byte(v>>(8*uint(i))))
+	}
+}
+
+func (t *Telemetry) put_string(s string) {
+	if len(s) > 255 {
+		s = s[:255]
+	}
+	t.put(uint64(len(s)), 1)
+	t.raw = append(t.raw, s...)
+}
+
+//adds the crc, COBS encodes the frame and writes it out
+func (t *Telemetry) finish() error {
+	t.put(uint64(xmodem_crc(t.raw)), 2)
+	t.cobs = cobs_encode(t.cobs[:0], t.raw)
+	t.cobs = append(t.cobs, 0)
+	_, err := t.w.Write(t.cobs)
+	return err
+}
+
+//Consistent overhead byte stuffing: every run of up to 254 non zero bytes gets a length byte
+//in front of it in place of the zero that ended it, so the encoded frame has no zeros in it.
+func cobs_encode(dst, src []byte) []byte {
+	code := len(dst)
+	dst = append(dst, 0)
+	n := byte(1)
+	for _, b := range src {
+		if b != 0 {
+			dst = append(dst, b)
+			n++
+		}
+		if b == 0 || n == 0xFF {
+			dst[code] = n
+			code = len(dst)
+			dst = append(dst, 0)
+			n = 1
+		}
+	}
+	dst[code] = n
+	return dst
+}
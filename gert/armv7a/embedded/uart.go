@@ -4,9 +4,47 @@
 
 package embedded
 
+import "errors"
+
+/*
+* iMX6 UARTs. There are five of them and they are all the same apart from their pins.
+* U-boot leaves UART1 set up at 115200 8N1 as the console, so it works without Begin.
+* Section 64 of the iMX6 Quad Applications Manual
+ */
+
 const (
 	READ_MASK = 0xFF
 	RRDY      = 1 << 9
+
+	UART_UCR1_UARTEN    = 1 << 0
+	UART_UCR2_SRST      = 1 << 0
+	UART_UCR2_RXEN      = 1 << 1
+	UART_UCR2_TXEN      = 1 << 2
+	UART_UCR2_WS        = 1 << 5
+	UART_UCR2_STPB      = 1 << 6
+	UART_UCR2_PROE      = 1 << 7
+	UART_UCR2_PREN      = 1 << 8
+	UART_UCR2_CTSC      = 1 << 13
+	UART_UCR2_IRTS      = 1 << 14
+	UART_UCR3_RXDMUXSEL = 1 << 2
+	UART_USR1_TRDY      = 1 << 13
+	UART_USR2_TXDC      = 1 << 3
+	UART_UTS_SOFTRST    = 1 << 0
+	UART_UTS_TXFULL     = 1 << 4
+
+	//the uart root clock is pll3/6 and Begin divides it by 2 again
+	UART_CLK_HZ = 80000000
+	UART_REF_HZ = UART_CLK_HZ / 2
+	UART_RFDIV2 = 4
+
+	//TRDY is set when fewer than UART_TXTL characters are waiting to go out
+	UART_FIFO_SIZE = 32
+	UART_TXTL      = 2
+	UART_RXTL      = 1
+
+	PARITY_NONE = 0
+	PARITY_EVEN = 1
+	PARITY_ODD  = 2
 )
 
 type UART_regs struct {
@@ -31,8 +69,113 @@ type UART_regs struct {
 	umcr  uint32
 }
 
+//either tx, rx, rts or cts. Inputs also have to be picked in the daisy chain register.
+//A nil muxctl means the signal isnt routed anywhere on this board
+type UART_pin struct {
+	name     string
+	alt      uint8
+	muxctl   *uint32
+	padctl   *uint32
+	daisy    *uint32
+	daisyval uint32
+}
+
 type UART struct {
 	regs *UART_regs
+	irq  uint32
+	tx   UART_pin
+	rx   UART_pin
+	rts  UART_pin
+	cts  UART_pin
+}
+
+func (p *UART_pin) configure() {
+	*p.muxctl = makeGPIOmuxconfig(p.alt)
+	*p.padctl = makeGPIOpadconfig(1, PULLUP_100K, 1, 1, 0, SPEED_MEDIUM, DRIVE_40R, SLEW_FAST)
+	if p.daisy != nil {
+		*p.daisy = p.daisyval
+	}
+}
+
+//Finds UBIR+1 and UBMR+1 so that (UBIR+1)/(UBMR+1) = 16*baud/UART_REF_HZ. They only have 16 bits each,
+//so if the fraction doesnt reduce far enough it gets rounded a little
+func uart_baud_ratio(baud uint32) (uint32, uint32) {
+	num := uint64(baud) * 16
+	den := uint64(UART_REF_HZ)
+	a, b := num, den
+	for b != 0 {
+		a, b = b, a%b
+	}
+	num /= a
+	den /= a
+	for num > 0x10000 || den > 0x10000 {
+		num = (num + 1) >> 1
+		den = (den + 1) >> 1
+	}
+	return uint32(num), uint32(den)
+}
+
+//Sets up the pins and the line. Parity is one of PARITY_NONE, PARITY_EVEN or PARITY_ODD,
+//stopbits is 1 or 2 and data is always 8 bits. Flow control uses the RTS/CTS pins, which only some uarts have.
+//This resets the uart, so anything still in its FIFOs is lost.
+func (u *UART) Begin(baud uint32, parity uint8, stopbits uint8, flowcontrol bool) error {
+	if baud == 0 || baud > UART_REF_HZ/16 {
+		return errors.New("bad baud rate")
+	}
+	if parity > PARITY_ODD {
+		return errors.New("bad parity")
+	}
+	if stopbits != 1 && stopbits != 2 {
+		return errors.New("stop bits must be 1 or 2")
+	}
+	if flowcontrol && (u.rts.muxctl == nil || u.cts.muxctl == nil) {
+		return errors.New("this uart has no rts/cts pins")
+	}
+
+	u.tx.configure()
+	u.rx.configure()
+	if flowcontrol {
+		u.rts.configure()
+		u.cts.configure()
+	}
+
+	//let whatever is being printed right now finish first
+	if u.regs.ucr1&UART_UCR1_UARTEN != 0 && u.regs.ucr2&UART_UCR2_TXEN != 0 {
+		u.Flush()
+	}
+	u.regs.ucr1 = 0
+	u.regs.ucr2 = 0
+	for u.regs.uts&UART_UTS_SOFTRST != 0 {
+	}
+
+	u.regs.ufcr = (UART_TXTL << 10) | (UART_RFDIV2 << 7) | UART_RXTL
+	//the iMX6 manual says this bit must always be set
+	u.regs.ucr3 |= UART_UCR3_RXDMUXSEL
+	u.regs.onems = UART_REF_HZ / 1000
+	//ubir has to be written before ubmr
+	num, den := uart_baud_ratio(baud)
+	u.regs.ubir = num - 1
+	u.regs.ubmr = den - 1
+
+	ucr2 := uint32(UART_UCR2_SRST | UART_UCR2_RXEN | UART_UCR2_TXEN | UART_UCR2_WS)
+	if stopbits == 2 {
+		ucr2 |= UART_UCR2_STPB
+	}
+	switch parity {
+	case PARITY_EVEN:
+		ucr2 |= UART_UCR2_PREN
+	case PARITY_ODD:
+		ucr2 |= UART_UCR2_PREN | UART_UCR2_PROE
+	}
+	if flowcontrol {
+		//the receiver drives CTS from its FIFO level and the transmitter waits on RTS
+		ucr2 |= UART_UCR2_CTSC
+	} else {
+		ucr2 |= UART_UCR2_IRTS
+	}
+	u.regs.ucr2 = ucr2
+	u.regs.ucr1 = UART_UCR1_UARTEN
+	return nil
 }
 
 //blocking read
@@ -49,3 +192,34 @@ func (u *UART) Read(n int) []byte {
 	}
 	return output
 }
+
+//blocking write
+func (u *UART) putchar(c byte) {
+	for u.regs.uts&UART_UTS_TXFULL != 0 {
+	}
+	u.regs.utxd = uint32(c)
+}
+
+//Busy waits until all of p is in the TX FIFO. Once TRDY says the FIFO is below the threshold
+//there are at least UART_FIFO_SIZE-UART_TXTL free slots, so those get filled without checking each byte.
+func (u *UART) Write(p []byte) (int, error) {
+	for i := 0; i < len(p); {
+		for u.regs.usr1&UART_USR1_TRDY == 0 {
+		}
+		for n := 0; n < UART_FIFO_SIZE-UART_TXTL && i < len(p); n++ {
+			u.regs.utxd = uint32(p[i])
+			i++
+		}
+	}
+	return len(p), nil
+}
+
+//waits until the last character has left the shift register
+func (u *UART) Flush() {
+	for u.regs.usr2&UART_USR2_TXDC == 0 {
+	}
+}
+
+func (u *UART) GetIRQnum() uint32 {
+	return u.irq
+}
@@ -0,0 +1,126 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package embedded
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+* ISRs cant call into the scheduler, so they cant wake up a goroutine themselves.
+* A Wakeup is the bridge. An ISR calls Signal, which only sets a flag and sends an event (SEV)
+* to every cpu. A goroutine calls Wait, which parks it on a channel like any other blocking call.
+* One waker goroutine, started the first time anything waits, hands the signals to the parked goroutines.
+* With nothing waiting the waker is parked too. With something waiting but nothing signalled it puts
+* its cpu to sleep in WFE until an interrupt or a SEV comes along, so waiting on ISRs costs one
+* sleeping cpu at most instead of a spinning cpu per waiter.
+* Waits with a timeout are the exception: nothing wakes the waker when they run out, so it keeps
+* yielding and checking the clock while one is outstanding. Only use them for things that finish quickly.
+ */
+
+//The zero value is ready to use
+type Wakeup struct {
+	pending uint32
+}
+
+type wakeup_waiter struct {
+	w        *Wakeup
+	deadline int64
+	ch       chan bool
+}
+
+var wakeup_add = make(chan wakeup_waiter, 64)
+var wakeup_once sync.Once
+
+//Sends an event to every cpu, so a WFE returns
+func sev()
+
+//Sleeps the cpu until an event or an interrupt
+func wfe()
+
+//Wakes the goroutine waiting on w, or the next one to wait if nobody is.
+//Signals dont add up: a goroutine that leaves work behind after it wakes should Signal again.
+//Safe to call from an ISR.
+//go:nosplit
+func (w *Wakeup) Signal() {
+	atomic.StoreUint32(&w.pending, 1)
+	sev()
+}
+
+//Parks the calling goroutine until Signal. Returns right away if Signal came since the last Wait.
+func (w *Wakeup) Wait() {
+	w.wait(0)
+}
+
+//Same as Wait, but gives up after d and returns false
+func (w *Wakeup) Wait_timeout(d time.Duration) bool {
+	Clock_init()
+	return w.wait(Nanotime() + int64(d))
+}
+
+func (w *Wakeup) wait(deadline int64) bool {
+	if atomic.SwapUint32(&w.pending, 0) != 0 {
+		return true
+	}
+	wakeup_once.Do(func() {
+		go wakeup_run()
+	})
+	ch := make(chan bool, 1)
+	wakeup_add <- wakeup_waiter{w, deadline, ch}
+	//the waker might be in WFE already
+	sev()
+	return <-ch
+}
+
+func wakeup_run() {
+	var waiting []wakeup_waiter
+	for {
+		if len(waiting) == 0 {
+			waiting = append(waiting, <-wakeup_add)
+		}
+		for more := true; more; {
+			select {
+			case x := <-wakeup_add:
+				waiting = append(waiting, x)
+			default:
+				more = false
+			}
+		}
+
+		now := int64(0)
+		kept := waiting[:0]
+		woke, timed := false, false
+		for _, x := range waiting {
+			if x.deadline != 0 && now == 0 {
+				now = Nanotime()
+			}
+			switch {
+			case atomic.SwapUint32(&x.w.pending, 0) != 0:
+				x.ch <- true
+				woke = true
+			case x.deadline != 0 && now >= x.deadline:
+				x.ch <- false
+				woke = true
+			default:
+				kept = append(kept, x)
+				timed = timed || x.deadline != 0
+			}
+		}
+		for i := len(kept); i < len(waiting); i++ {
+			waiting[i] = wakeup_waiter{}
+		}
+		waiting = kept
+
+		//the goroutines we just woke are on our run queue, let them go before we sleep.
+		//Any SEV from now on leaves the event register set, so the WFE below cant miss it.
+		runtime.Gosched()
+		if !woke && !timed && len(waiting) != 0 {
+			wfe()
+		}
+	}
+}
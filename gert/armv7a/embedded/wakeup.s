@@ -0,0 +1,17 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+#include "textflag.h"
+
+// func sev()
+// the dsb makes the flag Signal just stored visible before anyone wakes up to look at it
+TEXT ·sev(SB), NOSPLIT, $0-0
+	WORD $0xf57ff04f     // dsb
+	WORD $0xe320f004     // sev
+	RET
+
+// func wfe()
+TEXT ·wfe(SB), NOSPLIT, $0-0
+	WORD $0xe320f002     // wfe
+	RET
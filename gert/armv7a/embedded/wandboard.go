@@ -22,18 +22,18 @@ var WB_JP4_10 = GPIO_pin{"JP4_10", 1, 24, gpios[1-1], IOMUX_MUX_CTL_ENET_RX_ER,
 var WB_JP4_12 = GPIO_pin{"JP4_12", 7, 8, gpios[7-1], IOMUX_MUX_CTL_SD3_RST, IOMUX_PAD_CTL_SD3_RST}
 var WB_JP4_14 = GPIO_pin{"JP4_14", 3, 26, gpios[3-1], IOMUX_MUX_CTL_EIM_D26, IOMUX_PAD_CTL_EIM_D26}
 
-//SPI clock is 59.2MHz
-var WB_SPI1 = SPI_periph{SPI_pin{"mosi", 1, IOMUX_MUX_CTL_EIM_D18, IOMUX_PAD_CTL_EIM_D18},
-	SPI_pin{"miso", 1, IOMUX_MUX_CTL_EIM_D17, IOMUX_PAD_CTL_EIM_D17},
-	SPI_pin{"sclk", 1, IOMUX_MUX_CTL_EIM_D16, IOMUX_PAD_CTL_EIM_D16},
-	[]SPI_pin{
-		SPI_pin{"channel0", 1, IOMUX_MUX_CTL_EIM_EB2, IOMUX_PAD_CTL_EIM_EB2},
-		SPI_pin{"channel1", 0, IOMUX_MUX_CTL_KEY_COL2, IOMUX_PAD_CTL_KEY_COL2},
+//SPI clock is 60MHz, see SPI_root_clock
+var WB_SPI1 = &SPI_periph{mosi: SPI_pin{"mosi", 1, IOMUX_MUX_CTL_EIM_D18, IOMUX_PAD_CTL_EIM_D18, IOMUX_ECSPI1_MOSI_SELECT_INPUT, 0},
+	miso: SPI_pin{"miso", 1, IOMUX_MUX_CTL_EIM_D17, IOMUX_PAD_CTL_EIM_D17, IOMUX_ECSPI1_MISO_SELECT_INPUT, 0},
+	sclk: SPI_pin{"sclk", 1, IOMUX_MUX_CTL_EIM_D16, IOMUX_PAD_CTL_EIM_D16, IOMUX_ECSPI1_CSPI_CLK_IN_SELECT_INPUT, 0},
+	cs: []SPI_pin{
+		SPI_pin{"channel0", 1, IOMUX_MUX_CTL_EIM_EB2, IOMUX_PAD_CTL_EIM_EB2, IOMUX_ECSPI1_SS0_SELECT_INPUT, 0},
+		SPI_pin{"channel1", 0, IOMUX_MUX_CTL_KEY_COL2, IOMUX_PAD_CTL_KEY_COL2, IOMUX_ECSPI1_SS1_SELECT_INPUT, 2},
 	},
-	((*SPI_regs)(unsafe.Pointer(uintptr(0x2008000)))),
-	0,
-	0,
-	0}
+	regs:     ((*SPI_regs)(unsafe.Pointer(uintptr(0x2008000)))),
+	irq:      63,
+	rx_event: 3,
+	tx_event: 4}
 
 var WB_PWM1 = PWM_periph{PWM_pin{"JP1_17", 2, IOMUX_MUX_CTL_DISP0_DAT8, IOMUX_PAD_CTL_DISP0_DAT8}, ((*PWM_regs)(unsafe.Pointer(uintptr(0x2080000)))), 0, 0.0}
 var WB_PWM2 = PWM_periph{PWM_pin{"JP1_19", 2, IOMUX_MUX_CTL_DISP0_DAT9, IOMUX_PAD_CTL_DISP0_DAT9}, ((*PWM_regs)(unsafe.Pointer(uintptr(0x2084000)))), 0, 0.0}
@@ -42,4 +42,36 @@ var WB_PWM3 = PWM_periph{PWM_pin{"JP1_3", 2, IOMUX_MUX_CTL_SD4_DATA1, IOMUX_PAD_
 
 //var WB_PWM4 = PWM_periph{PWM_pin{"JP1_5", 2, IOMUX_MUX_CTL_SD4_DATA2, IOMUX_PAD_CTL_SD4_DATA2}, ((*PWM_regs)(unsafe.Pointer(uintptr(0x208C000))))}
 
-var WB_DEFAULT_UART = UART{((*UART_regs)(unsafe.Pointer(uintptr(0x2020000))))}
+//UART1 is the console on the DB9. UART2 shares its pins with JP4_6 and JP4_14 and UART3 with the bluetooth chip.
+//UART4 and UART5 are on the KEY pins, which are not on any header.
+var WB_UART1 = &UART{((*UART_regs)(unsafe.Pointer(uintptr(0x2020000)))), 58,
+	UART_pin{"tx", 3, IOMUX_MUX_CTL_CSI0_DAT10, IOMUX_PAD_CTL_CSI0_DAT10, nil, 0},
+	UART_pin{"rx", 3, IOMUX_MUX_CTL_CSI0_DAT11, IOMUX_PAD_CTL_CSI0_DAT11, IOMUX_UART1_RX_SELECT_INPUT, 1},
+	UART_pin{},
+	UART_pin{}}
+
+var WB_UART2 = &UART{((*UART_regs)(unsafe.Pointer(uintptr(0x21E8000)))), 59,
+	UART_pin{"tx", 4, IOMUX_MUX_CTL_EIM_D26, IOMUX_PAD_CTL_EIM_D26, nil, 0},
+	UART_pin{"rx", 4, IOMUX_MUX_CTL_EIM_D27, IOMUX_PAD_CTL_EIM_D27, IOMUX_UART2_RX_SELECT_INPUT, 1},
+	UART_pin{},
+	UART_pin{}}
+
+var WB_UART3 = &UART{((*UART_regs)(unsafe.Pointer(uintptr(0x21EC000)))), 60,
+	UART_pin{"tx", 2, IOMUX_MUX_CTL_EIM_D24, IOMUX_PAD_CTL_EIM_D24, nil, 0},
+	UART_pin{"rx", 2, IOMUX_MUX_CTL_EIM_D25, IOMUX_PAD_CTL_EIM_D25, IOMUX_UART3_RX_SELECT_INPUT, 1},
+	UART_pin{"rts", 2, IOMUX_MUX_CTL_EIM_EB3, IOMUX_PAD_CTL_EIM_EB3, IOMUX_UART3_RTS_SELECT_INPUT, 1},
+	UART_pin{"cts", 2, IOMUX_MUX_CTL_EIM_D23, IOMUX_PAD_CTL_EIM_D23, nil, 0}}
+
+var WB_UART4 = &UART{((*UART_regs)(unsafe.Pointer(uintptr(0x21F0000)))), 61,
+	UART_pin{"tx", 4, IOMUX_MUX_CTL_KEY_COL0, IOMUX_PAD_CTL_KEY_COL0, nil, 0},
+	UART_pin{"rx", 4, IOMUX_MUX_CTL_KEY_ROW0, IOMUX_PAD_CTL_KEY_ROW0, IOMUX_UART4_RX_SELECT_INPUT, 1},
+	UART_pin{},
+	UART_pin{}}
+
+var WB_UART5 = &UART{((*UART_regs)(unsafe.Pointer(uintptr(0x21F4000)))), 62,
+	UART_pin{"tx", 4, IOMUX_MUX_CTL_KEY_COL1, IOMUX_PAD_CTL_KEY_COL1, nil, 0},
+	UART_pin{"rx", 4, IOMUX_MUX_CTL_KEY_ROW1, IOMUX_PAD_CTL_KEY_ROW1, IOMUX_UART5_RX_SELECT_INPUT, 1},
+	UART_pin{},
+	UART_pin{}}
+
+var WB_DEFAULT_UART = WB_UART1
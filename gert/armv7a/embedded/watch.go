@@ -6,22 +6,29 @@ package embedded
 
 import "runtime"
 import "fmt"
+import "sync"
+import "sync/atomic"
+import "time"
 
+//A counter for ISRs to bump, like the GPT tick in irq.go. The unit is whatever the ISR says it is.
 type Counter struct {
 	clock uint32
 }
 
 var timer Counter
 
+//go:nosplit
 func Addtime(amt uint32) {
-	timer.clock += amt
+	atomic.AddUint32(&timer.clock, amt)
 }
+
+//go:nosplit
 func Gettime() uint32 {
-	curtime := timer.clock
-	return curtime
+	return atomic.LoadUint32(&timer.clock)
 }
 
-func Sleep(sleeptime uint32) uint32 {
+//yields until the Counter has gone up by sleeptime
+func Sleepticks(sleeptime uint32) uint32 {
 	curtime := Gettime()
 	for Gettime()-curtime < sleeptime {
 		runtime.Gosched()
@@ -29,17 +36,181 @@ func Sleep(sleeptime uint32) uint32 {
 	return Gettime()
 }
 
-func Busysleep(sleeptime uint32) uint32 {
+//spins until the Counter has gone up by sleeptime
+func Busysleepticks(sleeptime uint32) uint32 {
 	curtime := Gettime()
 	for Gettime()-curtime < sleeptime {
 	}
 	return Gettime()
 }
 
+/*
+* Monotonic time from the Cortex-A9 global timer.
+* It is a 64bit counter that all cpus share and it ticks at PERIPHCLK_HZ, so it never
+* wraps in practice and doesnt depend on how anyone set up the GPT.
+ */
+
+//Starts the global timer if it isnt running yet. Sleep and MakeTimerWheel call this for you.
+func Clock_init() {
+	Global_timer_start()
+}
+
+//Nanoseconds since the global timer was started. Safe to call from an ISR once the timer runs.
+//go:nosplit
+func Nanotime() int64 {
+	ticks := Global_timer_read()
+	sec := ticks / PERIPHCLK_HZ
+	rem := ticks % PERIPHCLK_HZ
+	return int64(sec*1000000000 + (rem*1000000000)/PERIPHCLK_HZ)
+}
+
+//time since an earlier Nanotime
+func Since(start int64) time.Duration {
+	return time.Duration(Nanotime() - start)
+}
+
+//yields the cpu to other goroutines until d has passed
+func Sleep(d time.Duration) time.Duration {
+	Clock_init()
+	start := Nanotime()
+	for Since(start) < d {
+		runtime.Gosched()
+	}
+	return Since(start)
+}
+
+//spins for d without giving up the cpu. Safe to call from an ISR if you really have to.
+//go:nosplit
+func BusyWait(d time.Duration) {
+	start := Nanotime()
+	for time.Duration(Nanotime()-start) < d {
+	}
+}
+
+/*
+* Timer wheel.
+* A ring of slots that each hold the timers expiring in that slot, advanced by one goroutine every
+* resolution. Callbacks run on that goroutine, not in an ISR, so they can allocate and use channels,
+* but a slow callback delays the ones after it.
+ */
+
+type Timer struct {
+	callback func()
+	expires  uint64
+	period   uint64
+	stopped  bool
+}
+
+type Timer_wheel struct {
+	sync.Mutex
+	slots      [][]*Timer
+	resolution time.Duration
+	start      int64
+	tick       uint64
+}
+
+//slots only matters for speed; timers further out than slots*resolution just go around more than once
+func MakeTimerWheel(resolution time.Duration, slots int) *Timer_wheel {
+	if resolution <= 0 || slots <= 0 {
+		panic("bad timer wheel size")
+	}
+	Clock_init()
+	w := &Timer_wheel{slots: make([][]*Timer, slots), resolution: resolution, start: Nanotime()}
+	go w.run()
+	return w
+}
+
+//calls f once, d from now
+func (w *Timer_wheel) After(d time.Duration, f func()) *Timer {
+	return w.add(d, 0, f)
+}
+
+//calls f every d, starting d from now
+func (w *Timer_wheel) Every(d time.Duration, f func()) *Timer {
+	return w.add(d, w.ticks(d), f)
+}
+
+//the timer wont fire after this returns, unless its callback has already started
+func (w *Timer_wheel) Stop(t *Timer) {
+	w.Lock()
+	t.stopped = true
+	w.Unlock()
+}
+
+func (w *Timer_wheel) ticks(d time.Duration) uint64 {
+	n := uint64((d + w.resolution - 1) / w.resolution)
+	if n == 0 {
+		n = 1
+	}
+	return n
+}
+
+func (w *Timer_wheel) add(d time.Duration, period uint64, f func()) *Timer {
+	w.Lock()
+	t := &Timer{callback: f, expires: w.tick + w.ticks(d), period: period}
+	w.insert(t)
+	w.Unlock()
+	return t
+}
+
+//must hold the lock
+func (w *Timer_wheel) insert(t *Timer) {
+	slot := t.expires % uint64(len(w.slots))
+	w.slots[slot] = append(w.slots[slot], t)
+}
+
+func (w *Timer_wheel) run() {
+	var due []*Timer
+	for {
+		Sleep(w.resolution)
+		now := uint64(Since(w.start) / w.resolution)
+		w.Lock()
+		//catch up on every tick we slept through
+		for w.tick < now {
+			w.tick++
+			slot := w.tick % uint64(len(w.slots))
+			kept := w.slots[slot][:0]
+			for _, t := range w.slots[slot] {
+				if t.stopped {
+					continue
+				}
+				if t.expires > w.tick {
+					kept = append(kept, t)
+					continue
+				}
+				due = append(due, t)
+			}
+			w.slots[slot] = kept
+		}
+		for _, t := range due {
+			if t.period != 0 {
+				t.expires += t.period
+				if t.expires <= w.tick {
+					//we fell behind, dont fire it a bunch of times in a row
+					t.expires = w.tick + 1
+				}
+				w.insert(t)
+			}
+		}
+		w.Unlock()
+		for i, t := range due {
+			//a Stop since we unlocked wins, or a callback could stop a timer due in the same tick and still see it fire
+			w.Lock()
+			stopped := t.stopped
+			w.Unlock()
+			if !stopped {
+				t.callback()
+			}
+			due[i] = nil
+		}
+		due = due[:0]
+	}
+}
+
 func Gopherwatch() {
 	for {
-		time := int(Sleep(2))
-		fmt.Printf("time is %x\r\n", time)
+		Sleep(2 * time.Second)
+		fmt.Printf("time is %v\r\n", time.Duration(Nanotime()))
 		//		fmt.Printf("last irq from %d\n", <-irqchan)
 	}
 }
@@ -0,0 +1,181 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package embedded
+
+import "unsafe"
+import "errors"
+import "fmt"
+import "sync"
+import "sync/atomic"
+import "time"
+
+/*
+* iMX6 watchdogs. Once a watchdog is enabled it cannot be turned off again,
+* so the only way to keep the board alive is to service it before it times out.
+* The pre-timeout interrupt gives you a chance to put the motors somewhere safe first.
+* Section 71 of the iMX6 Quad Applications Manual
+ */
+
+const (
+	WDOG_WCR_WDZST = 1 << 0
+	WDOG_WCR_WDBG  = 1 << 1
+	WDOG_WCR_WDE   = 1 << 2
+	WDOG_WCR_SRS   = 1 << 4
+	WDOG_WCR_WDA   = 1 << 5
+	WDOG_WICR_WTIS = 1 << 14
+	WDOG_WICR_WIE  = 1 << 15
+
+	//timeouts come in half seconds
+	WDOG_STEP        = 500 * time.Millisecond
+	WDOG_MAX_TIMEOUT = 128 * time.Second
+)
+
+type WDOG_regs struct {
+	WCR  uint16
+	WSR  uint16
+	WRSR uint16
+	WICR uint16
+	WMCR uint16
+}
+
+type WDOG_periph struct {
+	regs *WDOG_regs
+	irq  uint32
+}
+
+var WDOG1 = &WDOG_periph{(*WDOG_regs)(unsafe.Pointer(uintptr(0x20BC000))), 112}
+var WDOG2 = &WDOG_periph{(*WDOG_regs)(unsafe.Pointer(uintptr(0x20C0000))), 113}
+
+//Starts the watchdog. The board resets if nobody calls Service for timeout,
+//which gets rounded up to a half second between 0.5s and 128s.
+//The timeout can be changed later but the watchdog can never be stopped.
+//It pauses while a debugger has the cpu halted.
+func (w *WDOG_periph) Begin(timeout time.Duration) error {
+	if timeout <= 0 || timeout > WDOG_MAX_TIMEOUT {
+		return errors.New("watchdog timeout must be between 0.5s and 128s")
+	}
+	wt := uint16((timeout+WDOG_STEP-1)/WDOG_STEP) - 1
+
+	//the power down counter resets the board 16s after boot unless its turned off
+	w.regs.WMCR = 0
+	w.Service()
+	w.regs.WCR = (wt << 8) | WDOG_WCR_WDA | WDOG_WCR_SRS | WDOG_WCR_WDBG | WDOG_WCR_WDZST | WDOG_WCR_WDE
+	return nil
+}
+
+//Starts the count over
+//go:nosplit
+func (w *WDOG_periph) Service() {
+	w.regs.WSR = 0x5555
+	w.regs.WSR = 0xAAAA
+}
+
+//Runs handler on cpunum before this much time is left before the reset, between 0 and 127.5s.
+//The handler runs in IRQ mode so it must be nosplit and must not block or allocate.
+//The interrupt can only be turned on once per reset.
+func (w *WDOG_periph) EnablePretimeoutIntr(before time.Duration, cpunum uint32, priority uint8, handler Interrupt_handler) error {
+	if before < 0 || before >= WDOG_MAX_TIMEOUT {
+		return errors.New("watchdog pre-timeout must be between 0s and 127.5s")
+	}
+	wict := uint16(before / WDOG_STEP)
+	Register_interrupt(w.irq, cpunum, priority, handler, w.ClearIntr)
+	w.regs.WICR = WDOG_WICR_WIE | WDOG_WICR_WTIS | wict
+	return nil
+}
+
+//go:nosplit
+func (w *WDOG_periph) ClearIntr() {
+	w.regs.WICR |= WDOG_WICR_WTIS
+}
+
+//Resets the whole board right away, whether or not the watchdog was started
+func (w *WDOG_periph) Reset() {
+	w.regs.WCR &^= WDOG_WCR_SRS
+}
+
+//the reason for the last reset: bit 0 software, bit 1 this watchdog, bit 4 power on
+func (w *WDOG_periph) ResetStatus() uint16 {
+	return w.regs.WRSR
+}
+
+/*
+* Heartbeat supervision on top of a watchdog.
+* Critical goroutines each get a Heartbeat and have to Beat it at least every max.
+* The supervisor services the watchdog only while every heartbeat is fresh, so one wedged
+* goroutine (or a user_loop stuck in a for loop) is enough to reset the board.
+ */
+
+type Heartbeat struct {
+	last int64 //first so it is 64bit aligned for atomics
+	max  time.Duration
+	name string
+}
+
+type Watchdog_supervisor struct {
+	sync.Mutex
+	wdog       *WDOG_periph
+	heartbeats []*Heartbeat
+}
+
+//Starts wdog with timeout and a goroutine that services it every timeout/4 while all heartbeats are fresh
+func MakeWatchdogSupervisor(wdog *WDOG_periph, timeout time.Duration) (*Watchdog_supervisor, error) {
+	Clock_init()
+	if err := wdog.Begin(timeout); err != nil {
+		return nil, err
+	}
+	s := &Watchdog_supervisor{wdog: wdog}
+	go s.run(timeout / 4)
+	return s, nil
+}
+
+//The returned heartbeat counts as fresh for max from now
+func (s *Watchdog_supervisor) Register(name string, max time.Duration) *Heartbeat {
+	h := &Heartbeat{Nanotime(), max, name}
+	s.Lock()
+	s.heartbeats = append(s.heartbeats, h)
+	s.Unlock()
+	return h
+}
+
+//Safe to call from an ISR
+//go:nosplit
+func (h *Heartbeat) Beat() {
+	atomic.StoreInt64(&h.last, Nanotime())
+}
+
+func (h *Heartbeat) Name() string {
+	return h.name
+}
+
+func (h *Heartbeat) fresh(now int64) bool {
+	return time.Duration(now-atomic.LoadInt64(&h.last)) <= h.max
+}
+
+//names of the heartbeats that are late right now
+func (s *Watchdog_supervisor) Stale() []string {
+	now := Nanotime()
+	var names []string
+	s.Lock()
+	for _, h := range s.heartbeats {
+		if !h.fresh(now) {
+			names = append(names, h.name)
+		}
+	}
+	s.Unlock()
+	return names
+}
+
+//once anything goes stale the watchdog never gets serviced again, even if the heartbeat comes back
+func (s *Watchdog_supervisor) run(period time.Duration) {
+	for {
+		stale := s.Stale()
+		if len(stale) != 0 {
+			fmt.Printf("watchdog: stale heartbeats %v, letting the board reset\r\n", stale)
+			return
+		}
+		s.wdog.Service()
+		time.Sleep(period)
+	}
+}
@@ -48,7 +48,7 @@ func user_loop() {
 //	//		}
 //	//		fmt.Println(string(contents))
 //	//	}
-//	adc = embedded.MakeMCP3008(embedded.WB_SPI1)
+//	adc = embedded.MakeMCP3008(embedded.WB_SPI1, 0)
 //	drive = embedded.MakeMDD10A(embedded.WB_PWM1, embedded.WB_PWM2, embedded.WB_JP4_4, embedded.WB_JP4_6)
 //	event_chan = make(chan interface{}, 10)
 //	_ = embedded.Poll(func() interface{} {
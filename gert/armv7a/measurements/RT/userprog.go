@@ -50,7 +50,7 @@ func user_loop() {
 	//		fmt.Printf("count is %d\n", count)
 	//		ping = false
 	//	}
-	//embedded.Sleep(2)
+	//embedded.Sleepticks(2)
 	//fmt.Printf("count is %d\n", count)
 }
 
@@ -32,7 +32,7 @@ func user_init() {
 	//		}
 	//		fmt.Println(string(contents))
 	//	}
-	adc = embedded.MakeMCP3008(embedded.WB_SPI1)
+	adc = embedded.MakeMCP3008(embedded.WB_SPI1, 0)
 	drive = embedded.MakeMDD10A(embedded.WB_PWM1, embedded.WB_PWM2, embedded.WB_JP4_4, embedded.WB_JP4_6)
 	event_chan = make(chan interface{}, 10)
 	go func() {
@@ -43,7 +43,11 @@ func user_init() {
 
 	go func() {
 		for {
-			event_chan <- adc.Read(0)
+			if val, err := adc.Read(0); err != nil {
+				event_chan <- err
+			} else {
+				event_chan <- val
+			}
 			time.Sleep(2 * time.Second)
 		}
 	}()
@@ -105,8 +109,11 @@ func user_loop() {
 		switch event {
 		case "p":
 			//embedded.WB_SPI1.Send(0xAA)
-			val := adc.Read(0)
-			fmt.Printf("adc reads %v\n", val)
+			if val, err := adc.Read(0); err != nil {
+				fmt.Printf("adc: %v\n", err)
+			} else {
+				fmt.Printf("adc reads %v\n", val)
+			}
 		case "w":
 			drive.Forward(0.2)
 		case "s":
@@ -135,7 +142,7 @@ func user_loop() {
 	//		fmt.Printf("count is %d\n", count)
 	//		ping = false
 	//	}
-	//embedded.Sleep(2)
+	//embedded.Sleepticks(2)
 	//fmt.Printf("count is %d\n", count)
 }
 
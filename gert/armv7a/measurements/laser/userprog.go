@@ -74,7 +74,7 @@ func lasermon(commands chan LaserCommand, points []CompactPoint) {
 	skipcount := 0
 	lastx := uint16(0)
 	lasty := uint16(0)
-	dac := embedded.MakeMCP4922(embedded.WB_SPI1)
+	dac := embedded.MakeMCP4922(embedded.WB_SPI1, 0)
 	for {
 		select {
 		case command := <-commands:
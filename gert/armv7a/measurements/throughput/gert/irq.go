@@ -11,9 +11,6 @@ import "./embedded"
 * To amend this code, just modify the switch statement to look out for your IRQ
  */
 
-var heapchan chan int
-var didit bool
-
 //go:nosplit
 //go:nowritebarrierec
 func irq(irqnum uint32) {
@@ -25,45 +22,6 @@ func irq(irqnum uint32) {
 	//		irqchan <- runtime.Cpunum()
 	//	}
 
-	//cpunum := runtime.Cpunum()
-	if !didit {
-		//heapchan = make(chan int, 10)
-		didit = true
-	}
-	localvar := make([]int, 1)
-	localvar[0] = 10
-	if irqnum == 103 {
-		count1 = count1 + 1 + uint32(localvar[0])
-		embedded.ClearIntr(3)
-	} else if irqnum == 109 {
-		count2++
-		embedded.ClearIntr(6)
-	} else if irqnum == 99 {
-		count3++
-		embedded.ClearIntr(1)
-	} else if irqnum == 110 {
-		count4++
-		embedded.ClearIntr(7)
-	} else {
-	}
-
-	//	switch irqnum {
-	//	case 87:
-	//		embedded.Addtime(1)
-	//		embedded.ClearGPTIntr()
-	//	case 103:
-	//		count1++
-	//		embedded.ClearIntr(3)
-	//	case 109:
-	//		count2++
-	//		embedded.ClearIntr(6)
-	//	case 99:
-	//		count3++
-	//		embedded.ClearIntr(1)
-	//	case 110:
-	//		count4++
-	//		embedded.ClearIntr(7)
-	//	default:
-	//		//fmt.Printf("IRQ %d on cpu %d\n", irqnum, runtime.Cpunum())
-	//	}
+	//the GPIO banks go through GPIO_ISR to the handlers in userprog.go
+	embedded.Dispatch_interrupt(irqnum)
 }
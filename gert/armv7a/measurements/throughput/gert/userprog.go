@@ -38,18 +38,17 @@ func user_init() {
 	count4 = 0
 	//	ping = false
 	embedded.WB_JP4_6.SetInput()
-	embedded.WB_JP4_6.EnableIntr(embedded.INTR_RISING)
+	embedded.WB_JP4_6.EnableIntr(embedded.INTR_RISING, inc1)
 	embedded.WB_JP4_8.SetInput()
-	embedded.WB_JP4_8.EnableIntr(embedded.INTR_RISING)
+	embedded.WB_JP4_8.EnableIntr(embedded.INTR_RISING, inc2)
 	embedded.WB_JP4_10.SetInput()
-	embedded.WB_JP4_10.EnableIntr(embedded.INTR_RISING)
+	embedded.WB_JP4_10.EnableIntr(embedded.INTR_RISING, inc3)
 	embedded.WB_JP4_12.SetInput()
-	embedded.WB_JP4_12.EnableIntr(embedded.INTR_RISING)
-	//embedded.Enable_interrupt_mask(103, embedded.GICcpumask([]uint8{0, 1, 2, 3}), 0) //send GPIO3 interrupt to CPU0
-	embedded.Enable_interrupt_mask(103, embedded.GICcpumask([]uint8{0}), 0) //send GPIO3 interrupt to CPU0
-	embedded.Enable_interrupt_mask(109, embedded.GICcpumask([]uint8{1}), 1) //send GPIO3 interrupt to CPU0
-	embedded.Enable_interrupt_mask(99, embedded.GICcpumask([]uint8{2}), 2)  //send GPIO3 interrupt to CPU0
-	embedded.Enable_interrupt_mask(110, embedded.GICcpumask([]uint8{3}), 3) //send GPIO3 interrupt to CPU0
+	embedded.WB_JP4_12.EnableIntr(embedded.INTR_RISING, inc4)
+	//EnableIntr sends them all to CPU0, give every bank its own cpu
+	embedded.Register_interrupt(embedded.WB_JP4_8.GetIRQnum(), 1, 1, embedded.GPIO_ISR, nil)  //GPIO6 to CPU1
+	embedded.Register_interrupt(embedded.WB_JP4_10.GetIRQnum(), 2, 2, embedded.GPIO_ISR, nil) //GPIO1 to CPU2
+	embedded.Register_interrupt(embedded.WB_JP4_12.GetIRQnum(), 3, 3, embedded.GPIO_ISR, nil) //GPIO7 to CPU3
 	//	embedded.Enable_interrupt(109, 1, 1) //send GPIO6 interrupt to CPU1
 	//	embedded.Enable_interrupt(99, 2, 2)  //send GPIO1 interrupt to CPU2
 	//	embedded.Enable_interrupt(110, 3, 3) //send GPIO7 interrupt to CPU3
@@ -64,6 +63,26 @@ func user_init() {
 	//go embedded.Gopherwatch()
 }
 
+//go:nosplit
+func inc1() {
+	count1++
+}
+
+//go:nosplit
+func inc2() {
+	count2++
+}
+
+//go:nosplit
+func inc3() {
+	count3++
+}
+
+//go:nosplit
+func inc4() {
+	count4++
+}
+
 var oldcount uint32
 
 func user_loop() {
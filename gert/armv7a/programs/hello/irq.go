@@ -1,6 +1,6 @@
 package main
 
-//import "./embedded"
+import "../../embedded"
 
 /*
 * This is the interrupt handler for all IRQs in GERT.
@@ -8,7 +8,8 @@ package main
 * or trigger a garbage collection. This is because this code may run while locks are held
 * or even when the garbage collector is running too. This runs with CPSR=IRQ mode.
 *
-* To use this code, just modify the switch statement to look out for your IRQ
+* To use this code, just modify the switch statement to look out for your IRQ.
+* Anything you dont handle here goes to the handlers registered with embedded.Register_interrupt
  */
 
 //go:nosplit
@@ -16,6 +17,6 @@ package main
 func irq(irqnum uint32) {
 	switch irqnum {
 	default:
-		//fmt.Printf("IRQ %d on cpu %d\n", irqnum, runtime.Cpunum())
+		embedded.Dispatch_interrupt(irqnum)
 	}
 }
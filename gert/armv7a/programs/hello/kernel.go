@@ -54,6 +54,9 @@ ______                      ___  ___     _        _  ______            _   _
 	fmt.Printf("pre-init ...")
 	pre_init()
 	syscall.Setenv("TZ", "UTC")
+	if err := embedded.RTC_seed_time(); err != nil {
+		fmt.Printf("no wall-clock time from the RTC: %v\n", err)
+	}
 	runtime.Booted = 1
 	fmt.Printf("done!\n")
 
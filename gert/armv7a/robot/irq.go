@@ -22,12 +22,7 @@ func irq(irqnum uint32) {
 	case 87:
 		embedded.Addtime(1)
 		embedded.ClearGPTIntr()
-	case 99:
-		inc()
-		embedded.ClearIntr(1)
-	case 103:
-		embedded.ClearIntr(3)
 	default:
-		//fmt.Printf("IRQ %d on cpu %d\n", irqnum, runtime.Cpunum())
+		embedded.Dispatch_interrupt(irqnum)
 	}
 }
@@ -15,6 +15,7 @@ import (
 var event_chan chan interface{}
 var drive *embedded.MDD10A_controller
 var adc *embedded.MCP3008_controller
+var console *embedded.Buffered_UART
 
 func user_init() {
 
@@ -36,11 +37,14 @@ func user_init() {
 	//		}
 	//		fmt.Println(string(contents))
 	//	}
-	adc = embedded.MakeMCP3008(embedded.WB_SPI1)
+	adc = embedded.MakeMCP3008(embedded.WB_SPI1, 0)
 	drive = embedded.MakeMDD10A(embedded.WB_PWM1, embedded.WB_PWM2, embedded.WB_JP4_4, embedded.WB_JP4_6)
 	event_chan = make(chan interface{}, 10)
+	console = embedded.MakeBufferedUART(embedded.WB_DEFAULT_UART, 256, 0, 0xA0)
 	_ = embedded.Poll(func() interface{} {
-		return string(embedded.WB_DEFAULT_UART.Read(1)[:])
+		key := make([]byte, 1)
+		console.Read(key)
+		return string(key)
 	}, 0, event_chan)
 
 	_ = embedded.Poll(func() interface{} {
@@ -72,8 +76,7 @@ func user_init() {
 	}
 
 	embedded.WB_JP4_10.SetInput()
-	embedded.WB_JP4_10.EnableIntr(embedded.INTR_FALLING, inc)
-	embedded.Enable_interrupt(99, 0) //send GPIO1 interrupt to CPU0
+	embedded.WB_JP4_10.EnableIntr(embedded.INTR_FALLING, inc) //GPIO1 interrupt goes to CPU0
 }
 
 func user_loop() {
@@ -102,6 +105,7 @@ func user_loop() {
 
 var count uint32
 
+//go:nosplit
 func inc() {
 	count += 1
 }
@@ -0,0 +1,365 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//gertcom is a serial terminal for talking to the board. It replaces pycom.py.
+//Keys go straight to the board, ctrl-c included. Ctrl-] is the escape key:
+//
+//	ctrl-] q        quit
+//	ctrl-] u        upload a file, typed in line by line
+//	ctrl-] ctrl-]   send a ctrl-]
+//
+//Everything the board prints can be logged with a timestamp on every line, and
+//-on runs an action when a line matches a regex. The actions are
+//
+//	stop            wait for the board to go quiet, then exit with status 1
+//	quit            exit with status 0
+//	send TEXT       type TEXT and a carriage return
+//	upload FILE     type FILE in
+//
+//so a test run that should fail on a panic and pass when a program finishes looks like
+//
+//	gertcom -port /dev/ttyUSB0 -log run.log -on 'panic:=>stop' -on 'all done=>quit'
+//
+//With -pty there is no board, gertcom makes a pseudo terminal and prints the name of its other end
+//for qemu's -serial or anything else that can pretend to be the board.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"../serial"
+)
+
+const (
+	ESCAPE = 0x1D //ctrl-]
+	QUIET  = time.Second
+)
+
+type rule struct {
+	re     *regexp.Regexp
+	action string
+	arg    string
+}
+
+type rules []*rule
+
+func (r *rules) String() string {
+	return ""
+}
+
+//regex=>action
+func (r *rules) Set(s string) error {
+	i := strings.LastIndex(s, "=>")
+	if i < 0 {
+		return errors.New("want regex=>action")
+	}
+	re, err := regexp.Compile(s[:i])
+	if err != nil {
+		return err
+	}
+	fields := strings.SplitN(strings.TrimSpace(s[i+2:]), " ", 2)
+	ru := &rule{re: re, action: fields[0]}
+	if len(fields) == 2 {
+		ru.arg = fields[1]
+	}
+	switch ru.action {
+	case "stop", "quit":
+	case "send", "upload":
+		if ru.arg == "" {
+			return errors.New(ru.action + " needs an argument")
+		}
+	default:
+		return errors.New("unknown action " + ru.action)
+	}
+	*r = append(*r, ru)
+	return nil
+}
+
+var port *serial.Port
+var writes = make(chan []byte, 64)
+var restore func() error
+var logfile *bufio.Writer
+
+func quit(code int) {
+	if restore != nil {
+		restore()
+	}
+	if logfile != nil {
+		logfile.Flush()
+	}
+	os.Exit(code)
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "gertcom: %v\r\n", err)
+	quit(1)
+}
+
+//the only thing that writes to the port, so uploads and keys dont interleave inside a write
+func writer() {
+	for b := range writes {
+		if _, err := port.Write(b); err != nil {
+			fail(err)
+		}
+	}
+}
+
+func reader(out chan<- []byte) {
+	for {
+		buf := make([]byte, 256)
+		n, err := port.Read(buf)
+		if err != nil {
+			fail(err)
+		}
+		if n > 0 {
+			out <- buf[:n]
+		}
+	}
+}
+
+func keys(out chan<- []byte) {
+	for {
+		buf := make([]byte, 64)
+		n, err := os.Stdin.Read(buf)
+		if n > 0 {
+			out <- buf[:n]
+		}
+		if err != nil {
+			//stdin is a pipe that ran out, keep watching the board
+			close(out)
+			return
+		}
+	}
+}
+
+//types file in a line at a time, giving the board delay to deal with each line
+func upload(name string, delay time.Duration) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\r\ngertcom: %v\r\n", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\r\ngertcom: uploading %s, %d bytes\r\n", name, len(data))
+	go func() {
+		for len(data) > 0 {
+			n := bytes.IndexByte(data, '\n') + 1
+			if n == 0 {
+				n = len(data)
+			}
+			writes <- data[:n]
+			data = data[n:]
+			time.Sleep(delay)
+		}
+	}()
+}
+
+//Logs board output with a timestamp at the start of every line and runs the rules on it.
+//A rule fires at most once per line, and gets a look at the partial line too, so it can match a prompt.
+type watcher struct {
+	rules    rules
+	line     []byte
+	fired    []bool
+	midline  bool
+	stopping bool
+	delay    time.Duration
+}
+
+func (w *watcher) log(data []byte) {
+	if logfile == nil {
+		return
+	}
+	for _, c := range data {
+		if !w.midline {
+			logfile.WriteString(time.Now().Format("2006-01-02 15:04:05.000 "))
+			w.midline = true
+		}
+		if c == '\r' {
+			continue
+		}
+		logfile.WriteByte(c)
+		if c == '\n' {
+			w.midline = false
+		}
+	}
+	logfile.Flush()
+}
+
+func (w *watcher) check() {
+	for i, r := range w.rules {
+		if w.fired[i] || !r.re.Match(w.line) {
+			continue
+		}
+		w.fired[i] = true
+		switch r.action {
+		case "stop":
+			if !w.stopping {
+				fmt.Fprintf(os.Stderr, "\r\ngertcom: matched %q, stopping\r\n", r.re.String())
+			}
+			w.stopping = true
+		case "quit":
+			fmt.Fprintf(os.Stderr, "\r\ngertcom: matched %q\r\n", r.re.String())
+			quit(0)
+		case "send":
+			writes <- []byte(r.arg + "\r")
+		case "upload":
+			upload(r.arg, w.delay)
+		}
+	}
+}
+
+func (w *watcher) feed(data []byte) {
+	w.log(data)
+	for _, c := range data {
+		switch c {
+		case '\n':
+			w.check()
+			w.line = w.line[:0]
+			for i := range w.fired {
+				w.fired[i] = false
+			}
+		case '\r':
+		default:
+			w.line = append(w.line, c)
+		}
+	}
+	if len(w.line) > 0 {
+		w.check()
+	}
+}
+
+func main() {
+	var on rules
+	portname := flag.String("port", "/dev/ttyUSB0", "serial port the board is on")
+	baud := flag.Int("baud", 115200, "baud rate")
+	pty := flag.Bool("pty", false, "make a pseudo terminal for the board instead of opening -port")
+	logname := flag.String("log", "", "append everything the board prints to this file, timestamped")
+	send := flag.String("upload", "", "type this file in once connected")
+	delay := flag.Duration("delay", 20*time.Millisecond, "pause after every line of an upload")
+	flag.Var(&on, "on", "regex=>action, run action when a line from the board matches regex (repeatable)")
+	flag.Parse()
+	if flag.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "usage: gertcom [flags]\n")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	var err error
+	if *pty {
+		var name string
+		port, name, err = serial.OpenPTY()
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "gertcom: the board end is %s\n", name)
+		}
+	} else {
+		port, err = serial.Open(*portname, *baud)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gertcom: %v\n", err)
+		os.Exit(1)
+	}
+	if *logname != "" {
+		f, err := os.OpenFile(*logname, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gertcom: %v\n", err)
+			os.Exit(1)
+		}
+		logfile = bufio.NewWriter(f)
+	}
+	//not being a terminal is fine, then stdin is just more input for the board
+	interactive := false
+	if r, err := serial.MakeRaw(int(os.Stdin.Fd())); err == nil {
+		restore = r
+		interactive = true
+		fmt.Fprintf(os.Stderr, "gertcom: connected, ctrl-] q quits\r\n")
+	}
+
+	w := &watcher{rules: on, fired: make([]bool, len(on)), delay: *delay}
+	board := make(chan []byte, 64)
+	typed := make(chan []byte, 16)
+	go writer()
+	go reader(board)
+	go keys(typed)
+	if *send != "" {
+		upload(*send, *delay)
+	}
+
+	escaped := false
+	prompting := false
+	var filename []byte
+	quiet := time.NewTimer(QUIET)
+	for {
+		select {
+		case data := <-board:
+			os.Stdout.Write(data)
+			w.feed(data)
+			if w.stopping {
+				quiet.Reset(QUIET)
+			}
+		case <-quiet.C:
+			if w.stopping {
+				quit(1)
+			}
+		case data, ok := <-typed:
+			if !ok {
+				typed = nil
+				continue
+			}
+			if !interactive {
+				writes <- data
+				continue
+			}
+			var out []byte
+			for _, c := range data {
+				switch {
+				case prompting:
+					switch c {
+					case '\r', '\n':
+						prompting = false
+						upload(string(filename), *delay)
+					case 0x7F, 0x08:
+						if len(filename) > 0 {
+							filename = filename[:len(filename)-1]
+							os.Stderr.Write([]byte("\b \b"))
+						}
+					case 0x03:
+						prompting = false
+						os.Stderr.Write([]byte("\r\n"))
+					default:
+						filename = append(filename, c)
+						os.Stderr.Write([]byte{c})
+					}
+				case escaped:
+					escaped = false
+					switch c {
+					case 'q', 'Q':
+						os.Stderr.Write([]byte("\r\n"))
+						quit(0)
+					case 'u', 'U':
+						prompting = true
+						filename = filename[:0]
+						os.Stderr.Write([]byte("\r\nupload: "))
+					case ESCAPE:
+						out = append(out, c)
+					}
+				case c == ESCAPE:
+					escaped = true
+				default:
+					out = append(out, c)
+				}
+			}
+			if len(out) > 0 {
+				writes <- out
+			}
+		}
+	}
+}
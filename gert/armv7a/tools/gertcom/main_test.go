@@ -0,0 +1,175 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"../serial"
+)
+
+//main calls os.Exit, so the tests run it in a copy of the test binary with this set
+const CHILD_ENV = "GERTCOM_TEST_ARGS"
+
+func TestMain(m *testing.M) {
+	if args := os.Getenv(CHILD_ENV); args != "" {
+		os.Args = append([]string{"gertcom"}, strings.Split(args, "\n")...)
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+//a gertcom -pty running in the background, and the board end of its pty
+type session struct {
+	t     *testing.T
+	cmd   *exec.Cmd
+	board *serial.Port
+	done  chan error
+}
+
+func start(t *testing.T, args ...string) *session {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), CHILD_ENV+"="+strings.Join(append([]string{"-pty"}, args...), "\n"))
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	s := &session{t: t, cmd: cmd, done: make(chan error, 1)}
+
+	names := make(chan string, 1)
+	go func() {
+		re := regexp.MustCompile(`the board end is (\S+)`)
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			if m := re.FindStringSubmatch(scanner.Text()); m != nil {
+				names <- m[1]
+			}
+		}
+	}()
+	select {
+	case name := <-names:
+		s.board, err = serial.Open(name, 115200)
+		if err != nil {
+			cmd.Process.Kill()
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("gertcom never said where the pty is")
+	}
+	go func() {
+		s.done <- cmd.Wait()
+	}()
+	return s
+}
+
+func (s *session) print(text string) {
+	if _, err := s.board.Write([]byte(text)); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+//reads what gertcom types at the board until want shows up
+func (s *session) expect(want string) {
+	var got []byte
+	buf := make([]byte, 64)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		n, err := s.board.Read(buf)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+		if bytes.Contains(got, []byte(want)) {
+			return
+		}
+	}
+	s.t.Fatalf("gertcom sent %q, want %q", got, want)
+}
+
+//waits for gertcom to exit and returns its status
+func (s *session) exit(timeout time.Duration) int {
+	defer s.board.Close()
+	select {
+	case err := <-s.done:
+		if err == nil {
+			return 0
+		}
+		if e, ok := err.(*exec.ExitError); ok {
+			return e.Sys().(syscall.WaitStatus).ExitStatus()
+		}
+		s.t.Fatal(err)
+	case <-time.After(timeout):
+		s.cmd.Process.Kill()
+		s.t.Fatal("gertcom didnt exit")
+	}
+	return -1
+}
+
+func TestSendAndLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gertcom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logname := filepath.Join(dir, "run.log")
+
+	s := start(t, "-log", logname, "-on", "login: $=>send root", "-on", "all done=>quit")
+	s.print("booting\r\nlogin: ")
+	s.expect("root\r")
+	s.print("root\r\nall done\r\n")
+	if code := s.exit(5 * time.Second); code != 0 {
+		t.Fatalf("exit status %d, want 0", code)
+	}
+
+	data, err := ioutil.ReadFile(logname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	want := []string{"booting", "login: root", "all done"}
+	if len(lines) != len(want) {
+		t.Fatalf("log is %q, want %d lines", data, len(want))
+	}
+	stamp := regexp.MustCompile(`^\d{4}-\d\d-\d\d \d\d:\d\d:\d\d\.\d{3} `)
+	for i, line := range lines {
+		if !stamp.MatchString(line) {
+			t.Errorf("line %q has no timestamp", line)
+			continue
+		}
+		if got := stamp.ReplaceAllString(line, ""); got != want[i] {
+			t.Errorf("line %d is %q, want %q", i, got, want[i])
+		}
+	}
+}
+
+func TestStop(t *testing.T) {
+	s := start(t, "-on", "panic:=>stop", "-on", "all done=>quit")
+	s.print("panic: oops\r\n")
+	//still printing the stack, so it has to wait for quiet
+	time.Sleep(QUIET / 2)
+	s.print("goroutine 1 [running]:\r\n")
+	began := time.Now()
+	if code := s.exit(5 * time.Second); code != 1 {
+		t.Fatalf("exit status %d, want 1", code)
+	}
+	if waited := time.Since(began); waited < QUIET/2 {
+		t.Fatalf("exited %v after the last line, want about %v", waited, QUIET)
+	}
+}
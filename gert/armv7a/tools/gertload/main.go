@@ -0,0 +1,206 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//gertload sends a bootloader.elf to a board that is running embedded.Chainload_command.
+//It types the load command into the shell, waits for the board to ask for the file,
+//and sends it with YMODEM (or XMODEM-1K with -xmodem).
+//
+//	gertload -port /dev/ttyUSB0 obj/bootloader.elf
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"../serial"
+)
+
+const (
+	SOH = 0x01
+	STX = 0x02
+	EOT = 0x04
+	ACK = 0x06
+	NAK = 0x15
+	CAN = 0x18
+	C   = 'C'
+
+	RETRIES = 10
+)
+
+var port *serial.Port
+
+//returns false if nothing came within timeout
+func getc(timeout time.Duration) (byte, bool) {
+	deadline := time.Now().Add(timeout)
+	var b [1]byte
+	for time.Now().Before(deadline) {
+		n, err := port.Read(b[:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gertload: %v\n", err)
+			os.Exit(1)
+		}
+		if n == 1 {
+			return b[0], true
+		}
+	}
+	return 0, false
+}
+
+func crc16(data []byte) uint16 {
+	crc := uint16(0)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = (crc << 1) ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+//sends one block until the receiver ACKs it
+func send_block(num uint8, data []byte) error {
+	head := byte(SOH)
+	if len(data) == 1024 {
+		head = STX
+	}
+	crc := crc16(data)
+	pkt := append([]byte{head, num, ^num}, data...)
+	pkt = append(pkt, byte(crc>>8), byte(crc))
+	for try := 0; try < RETRIES; try++ {
+		port.Write(pkt)
+		c, ok := getc(10 * time.Second)
+		switch {
+		case !ok:
+			continue
+		case c == ACK:
+			return nil
+		case c == CAN:
+			return errors.New("board cancelled")
+		}
+	}
+	return errors.New("too many retries")
+}
+
+//waits for the receiver to ask for CRC mode, echoing whatever else the board prints meanwhile
+func wait_for_c(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		c, ok := getc(time.Second)
+		if !ok {
+			continue
+		}
+		if c == C {
+			return nil
+		}
+		if c == CAN {
+			return errors.New("board cancelled")
+		}
+		os.Stdout.Write([]byte{c})
+	}
+	return errors.New("board never asked for the file")
+}
+
+func send(name string, image []byte, ymodem bool) error {
+	if err := wait_for_c(time.Minute); err != nil {
+		return err
+	}
+	if ymodem {
+		header := make([]byte, 128)
+		copy(header, fmt.Sprintf("%s\x00%d", filepath.Base(name), len(image)))
+		if err := send_block(0, header); err != nil {
+			return err
+		}
+		if err := wait_for_c(10 * time.Second); err != nil {
+			return err
+		}
+	}
+
+	num := uint8(1)
+	for off := 0; off < len(image); off += 1024 {
+		block := make([]byte, 1024)
+		for i := range block {
+			block[i] = 0x1A
+		}
+		n := copy(block, image[off:])
+		if err := send_block(num, block); err != nil {
+			return err
+		}
+		num++
+		fmt.Printf("\r%d/%d bytes", off+n, len(image))
+	}
+	fmt.Printf("\n")
+
+	for try := 0; ; try++ {
+		if try == RETRIES {
+			return errors.New("board never took the EOT")
+		}
+		port.Write([]byte{EOT})
+		if c, ok := getc(10 * time.Second); ok && c == ACK {
+			break
+		}
+	}
+	if ymodem {
+		//an empty header ends the batch
+		if err := wait_for_c(10 * time.Second); err != nil {
+			return err
+		}
+		if err := send_block(0, make([]byte, 128)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	portname := flag.String("port", "/dev/ttyUSB0", "serial port the board is on")
+	baud := flag.Int("baud", 115200, "baud rate")
+	cmd := flag.String("cmd", "load reset", "shell command that starts the receiver, or empty if it is already waiting")
+	xmodem := flag.Bool("xmodem", false, "use XMODEM-1K instead of YMODEM")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: gertload [flags] bootloader.elf\n")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	image, err := ioutil.ReadFile(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gertload: %v\n", err)
+		os.Exit(1)
+	}
+	port, err = serial.Open(*portname, *baud)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gertload: %v\n", err)
+		os.Exit(1)
+	}
+	defer port.Close()
+
+	fmt.Printf("sending %s, %d bytes, crc32 0x%08x\n", flag.Arg(0), len(image), crc32.ChecksumIEEE(image))
+	if *cmd != "" {
+		port.Write([]byte(*cmd + "\r"))
+	}
+	if err := send(flag.Arg(0), image, !*xmodem); err != nil {
+		port.Write([]byte{CAN, CAN, CAN})
+		fmt.Fprintf(os.Stderr, "gertload: %v\n", err)
+		os.Exit(1)
+	}
+	//show the board booting the new image
+	for {
+		c, ok := getc(5 * time.Second)
+		if !ok {
+			return
+		}
+		os.Stdout.Write([]byte{c})
+	}
+}
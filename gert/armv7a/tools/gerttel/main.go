@@ -0,0 +1,324 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//gerttel decodes the frames embedded.Telemetry sends and prints them as CSV or JSON.
+//The stream describes its own message types, so it works with any program.
+//
+//	gerttel -port /dev/ttyUSB1 -format csv -type latency > latency.csv
+//	gerttel -in capture.bin -format json
+//
+//CSV gets a header row the first time each type shows up. The time column is nanoseconds
+//since the board's global timer started. Bad frames and frames lost in between are counted on stderr.
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"strconv"
+
+	"../serial"
+)
+
+//these match embedded/telemetry.go
+const (
+	DESCRIBE = 0
+
+	BOOL = 1
+	I8   = 2
+	U8   = 3
+	I16  = 4
+	U16  = 5
+	I32  = 6
+	U32  = 7
+	I64  = 8
+	U64  = 9
+	F32  = 10
+	F64  = 11
+
+	HEADER = 1 + 1 + 8
+	CRC    = 2
+)
+
+type field struct {
+	name string
+	kind uint8
+}
+
+type msgtype struct {
+	name    string
+	fields  []field
+	size    int
+	printed bool
+}
+
+var types = map[uint8]*msgtype{}
+var bad, lost, unknown, good int
+
+func size(kind uint8) int {
+	switch kind {
+	case BOOL, I8, U8:
+		return 1
+	case I16, U16:
+		return 2
+	case I32, U32, F32:
+		return 4
+	}
+	return 8
+}
+
+func crc16(data []byte) uint16 {
+	crc := uint16(0)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = (crc << 1) ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func cobs_decode(src []byte) ([]byte, error) {
+	dst := make([]byte, 0, len(src))
+	for i := 0; i < len(src); {
+		code := int(src[i])
+		if code == 0 || i+code > len(src) {
+			return nil, errors.New("bad cobs")
+		}
+		dst = append(dst, src[i+1:i+code]...)
+		i += code
+		if code != 0xFF && i < len(src) {
+			dst = append(dst, 0)
+		}
+	}
+	return dst, nil
+}
+
+func le(b []byte) uint64 {
+	v := uint64(0)
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v
+}
+
+//a field as text, ints exactly and floats as short as they can be
+func format(kind uint8, b []byte) string {
+	v := le(b)
+	switch kind {
+	case BOOL:
+		return strconv.FormatBool(v != 0)
+	case I8:
+		return strconv.FormatInt(int64(int8(v)), 10)
+	case I16:
+		return strconv.FormatInt(int64(int16(v)), 10)
+	case I32:
+		return strconv.FormatInt(int64(int32(v)), 10)
+	case I64:
+		return strconv.FormatInt(int64(v), 10)
+	case F32:
+		return strconv.FormatFloat(float64(math.Float32frombits(uint32(v))), 'g', -1, 32)
+	case F64:
+		return strconv.FormatFloat(math.Float64frombits(v), 'g', -1, 64)
+	}
+	return strconv.FormatUint(v, 10)
+}
+
+func describe(body []byte) error {
+	short := errors.New("short description")
+	if len(body) < 2 {
+		return short
+	}
+	id := body[0]
+	n := int(body[1])
+	if len(body) < 3+n {
+		return short
+	}
+	mt := &msgtype{name: string(body[2 : 2+n])}
+	body = body[2+n:]
+	count := int(body[0])
+	body = body[1:]
+	for i := 0; i < count; i++ {
+		if len(body) < 2 || len(body) < 2+int(body[1]) {
+			return short
+		}
+		f := field{kind: body[0], name: string(body[2 : 2+int(body[1])])}
+		body = body[2+int(body[1]):]
+		mt.fields = append(mt.fields, f)
+		mt.size += size(f.kind)
+	}
+	//the same description comes around every so often, keep the header state
+	if old, ok := types[id]; ok && old.name == mt.name && len(old.fields) == len(mt.fields) {
+		return nil
+	}
+	types[id] = mt
+	return nil
+}
+
+type printer struct {
+	json   bool
+	filter string
+	csv    *csv.Writer
+	out    *bufio.Writer
+}
+
+func (p *printer) print(mt *msgtype, seq uint8, t uint64, body []byte) {
+	if p.filter != "" && mt.name != p.filter {
+		return
+	}
+	values := make([]string, len(mt.fields))
+	for i, f := range mt.fields {
+		n := size(f.kind)
+		values[i] = format(f.kind, body[:n])
+		body = body[n:]
+	}
+	if p.json {
+		//written by hand so the fields stay in order
+		name, _ := json.Marshal(mt.name)
+		fmt.Fprintf(p.out, `{"type":%s,"seq":%d,"time":%d`, name, seq, t)
+		for i, f := range mt.fields {
+			key, _ := json.Marshal(f.name)
+			v := values[i]
+			if v == "NaN" || v == "+Inf" || v == "-Inf" {
+				v = `"` + v + `"`
+			}
+			fmt.Fprintf(p.out, `,%s:%s`, key, v)
+		}
+		fmt.Fprintf(p.out, "}\n")
+		p.out.Flush()
+		return
+	}
+	if !mt.printed {
+		header := []string{"type", "seq", "time"}
+		for _, f := range mt.fields {
+			header = append(header, f.name)
+		}
+		p.csv.Write(header)
+		mt.printed = true
+	}
+	p.csv.Write(append([]string{mt.name, strconv.Itoa(int(seq)), strconv.FormatUint(t, 10)}, values...))
+	p.csv.Flush()
+}
+
+var lastseq int = -1
+
+func frame(p *printer, encoded []byte) {
+	raw, err := cobs_decode(encoded)
+	if err != nil || len(raw) < HEADER+CRC {
+		bad++
+		return
+	}
+	body := raw[:len(raw)-CRC]
+	if uint16(le(raw[len(raw)-CRC:])) != crc16(body) {
+		bad++
+		return
+	}
+	id := body[0]
+	seq := body[1]
+	t := le(body[2:HEADER])
+	if lastseq >= 0 && seq != uint8(lastseq+1) {
+		lost += int(seq - uint8(lastseq+1))
+	}
+	lastseq = int(seq)
+	body = body[HEADER:]
+	if id == DESCRIBE {
+		if describe(body) != nil {
+			bad++
+		}
+		return
+	}
+	mt, ok := types[id]
+	if !ok || len(body) != mt.size {
+		//started listening after the descriptions went out, they come around again
+		unknown++
+		return
+	}
+	good++
+	p.print(mt, seq, t, body)
+}
+
+func stats() {
+	fmt.Fprintf(os.Stderr, "gerttel: %d frames, %d bad, %d lost, %d before their description\n", good, bad, lost, unknown)
+}
+
+func main() {
+	portname := flag.String("port", "", "serial port the telemetry comes in on")
+	baud := flag.Int("baud", 115200, "baud rate")
+	in := flag.String("in", "", "read a captured stream from this file instead, - for stdin")
+	format := flag.String("format", "csv", "csv or json")
+	filter := flag.String("type", "", "only print this message type")
+	flag.Parse()
+	if (*portname == "") == (*in == "") || (*format != "csv" && *format != "json") {
+		fmt.Fprintf(os.Stderr, "usage: gerttel -port name | -in file [flags]\n")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	var r io.Reader
+	switch {
+	case *in == "-":
+		r = os.Stdin
+	case *in != "":
+		f, err := os.Open(*in)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gerttel: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		r = f
+	default:
+		port, err := serial.Open(*portname, *baud)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gerttel: %v\n", err)
+			os.Exit(1)
+		}
+		defer port.Close()
+		r = port
+		//a port never ends, so say how it went on ctrl-c
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt)
+		go func() {
+			<-sig
+			stats()
+			os.Exit(0)
+		}()
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	p := &printer{json: *format == "json", filter: *filter, csv: csv.NewWriter(out), out: out}
+	var pending []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		for _, c := range buf[:n] {
+			if c != 0 {
+				pending = append(pending, c)
+				continue
+			}
+			if len(pending) > 0 {
+				frame(p, pending)
+			}
+			pending = pending[:0]
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gerttel: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	stats()
+}
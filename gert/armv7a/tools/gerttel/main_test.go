@@ -0,0 +1,257 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+/*
+* Frames get built here the way embedded/telemetry.go builds them, so a change on either side
+* that the other doesnt follow shows up as a failure.
+ */
+
+//a copy of cobs_encode in embedded/telemetry.go
+func cobs_encode(dst, src []byte) []byte {
+	code := len(dst)
+	dst = append(dst, 0)
+	n := byte(1)
+	for _, b := range src {
+		if b != 0 {
+			dst = append(dst, b)
+			n++
+		}
+		if b == 0 || n == 0xFF {
+			dst[code] = n
+			code = len(dst)
+			dst = append(dst, 0)
+			n = 1
+		}
+	}
+	dst[code] = n
+	return dst
+}
+
+type builder struct {
+	raw []byte
+	seq uint8
+}
+
+func (b *builder) put(v uint64, size int) {
+	for i := 0; i < size; i++ {
+		b.raw = append(b.raw, byte(v>>(8*uint(i))))
+	}
+}
+
+func (b *builder) put_string(s string) {
+	b.put(uint64(len(s)), 1)
+	b.raw = append(b.raw, s...)
+}
+
+func (b *builder) start(id uint8, t uint64) {
+	b.raw = b.raw[:0]
+	b.put(uint64(id), 1)
+	b.put(uint64(b.seq), 1)
+	b.seq++
+	b.put(t, 8)
+}
+
+//the frame COBS encoded, without the zero that ends it on the wire
+func (b *builder) finish() []byte {
+	b.put(uint64(crc16(b.raw)), 2)
+	return cobs_encode(nil, b.raw)
+}
+
+func (b *builder) describe(id uint8, name string, fields []field) []byte {
+	b.start(DESCRIBE, 0)
+	b.put(uint64(id), 1)
+	b.put_string(name)
+	b.put(uint64(len(fields)), 1)
+	for _, f := range fields {
+		b.put(uint64(f.kind), 1)
+		b.put_string(f.name)
+	}
+	return b.finish()
+}
+
+func reset() {
+	types = map[uint8]*msgtype{}
+	bad, lost, unknown, good = 0, 0, 0, 0
+	lastseq = -1
+}
+
+func make_printer(json bool, filter string) (*printer, *bytes.Buffer) {
+	var buf bytes.Buffer
+	out := bufio.NewWriter(&buf)
+	return &printer{json: json, filter: filter, csv: csv.NewWriter(out), out: out}, &buf
+}
+
+var sample_fields = []field{
+	{"Ok", BOOL},
+	{"Delta", I16},
+	{"Count", U32},
+	{"Value", F32},
+	{"Big", I64},
+}
+
+//one sample frame with ok, delta, count, value and big
+func (b *builder) sample(t uint64, ok bool, delta int16, count uint32, value float32, big int64) []byte {
+	b.start(1, t)
+	v := uint64(0)
+	if ok {
+		v = 1
+	}
+	b.put(v, 1)
+	b.put(uint64(uint16(delta)), 2)
+	b.put(uint64(count), 4)
+	b.put(uint64(math.Float32bits(value)), 4)
+	b.put(uint64(big), 8)
+	return b.finish()
+}
+
+func TestCrc16(t *testing.T) {
+	//the XMODEM check value
+	if got := crc16([]byte("123456789")); got != 0x31C3 {
+		t.Fatalf("crc16 is 0x%04x, want 0x31c3", got)
+	}
+}
+
+func TestCobs(t *testing.T) {
+	long := make([]byte, 600)
+	for i := range long {
+		long[i] = byte(i%255) + 1
+	}
+	cases := [][]byte{
+		{},
+		{0},
+		{0, 0},
+		{1, 2, 3},
+		{1, 0, 2, 0},
+		long[:253],
+		long[:254],
+		long[:255],
+		long,
+		append(append([]byte{0}, long[:300]...), 0),
+	}
+	for _, want := range cases {
+		encoded := cobs_encode(nil, want)
+		if bytes.IndexByte(encoded, 0) >= 0 {
+			t.Errorf("encoding of %d bytes has a zero in it", len(want))
+			continue
+		}
+		got, err := cobs_decode(encoded)
+		if err != nil {
+			t.Errorf("decoding %d bytes: %v", len(want), err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("decoded %x, want %x", got, want)
+		}
+	}
+	for _, broken := range [][]byte{{5, 1, 2}, {2, 1, 0}} {
+		if _, err := cobs_decode(broken); err == nil {
+			t.Errorf("decoded %x without an error", broken)
+		}
+	}
+}
+
+func TestCSV(t *testing.T) {
+	reset()
+	p, out := make_printer(false, "")
+	var b builder
+	frame(p, b.describe(1, "latency", sample_fields))
+	frame(p, b.sample(1000, true, -5, 7, 1.5, -1<<40))
+	frame(p, b.sample(2000, false, 300, 0, float32(math.Inf(1)), 3))
+	want := "type,seq,time,Ok,Delta,Count,Value,Big\n" +
+		"latency,1,1000,true,-5,7,1.5,-1099511627776\n" +
+		"latency,2,2000,false,300,0,+Inf,3\n"
+	if out.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", out.String(), want)
+	}
+	if good != 2 || bad != 0 || lost != 0 || unknown != 0 {
+		t.Fatalf("good %d bad %d lost %d unknown %d", good, bad, lost, unknown)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	reset()
+	p, out := make_printer(true, "")
+	var b builder
+	frame(p, b.describe(1, "a \"quoted\" name", sample_fields))
+	frame(p, b.sample(42, true, 1, 2, float32(math.NaN()), 4))
+	want := `{"type":"a \"quoted\" name","seq":1,"time":42,"Ok":true,"Delta":1,"Count":2,"Value":"NaN","Big":4}` + "\n"
+	if out.String() != want {
+		t.Fatalf("got %s want %s", out.String(), want)
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &v); err != nil {
+		t.Fatalf("not json: %v", err)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	reset()
+	p, out := make_printer(false, "other")
+	var b builder
+	frame(p, b.describe(1, "latency", sample_fields))
+	frame(p, b.sample(1, true, 0, 0, 0, 0))
+	if out.Len() != 0 {
+		t.Fatalf("printed %q for a type that was filtered out", out.String())
+	}
+}
+
+func TestBadFrames(t *testing.T) {
+	reset()
+	p, out := make_printer(false, "")
+	var b builder
+	frame(p, b.describe(1, "latency", sample_fields))
+
+	//flip a bit in the body, the crc has to catch it
+	b.sample(1, true, 0, 0, 0, 0)
+	b.raw[HEADER] ^= 1
+	frame(p, cobs_encode(nil, b.raw))
+	//and in the crc itself
+	b.sample(2, true, 0, 0, 0, 0)
+	b.raw[len(b.raw)-1] ^= 0x80
+	frame(p, cobs_encode(nil, b.raw))
+	//too short to have a header
+	frame(p, cobs_encode(nil, []byte{1, 2, 3}))
+	//not cobs
+	frame(p, []byte{9, 1})
+	if bad != 4 || good != 0 {
+		t.Fatalf("bad %d good %d, want 4 and 0", bad, good)
+	}
+	if out.Len() != 0 {
+		t.Fatalf("printed %q from bad frames", out.String())
+	}
+}
+
+func TestLostAndUnknown(t *testing.T) {
+	reset()
+	p, _ := make_printer(false, "")
+	var b builder
+	//a sample before its description, like when listening starts in the middle of a stream
+	frame(p, b.sample(1, true, 0, 0, 0, 0))
+	frame(p, b.describe(1, "latency", sample_fields))
+	frame(p, b.sample(2, true, 0, 0, 0, 0))
+	b.seq += 3
+	frame(p, b.sample(3, true, 0, 0, 0, 0))
+	if unknown != 1 || good != 2 || lost != 3 {
+		t.Fatalf("unknown %d good %d lost %d, want 1 2 3", unknown, good, lost)
+	}
+	//the sequence number wraps
+	b.seq = 255
+	lastseq = 254
+	frame(p, b.sample(4, true, 0, 0, 0, 0))
+	frame(p, b.sample(5, true, 0, 0, 0, 0))
+	if lost != 3 || good != 4 {
+		t.Fatalf("lost %d good %d across the wrap, want 3 and 4", lost, good)
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package serial
+
+import (
+	"bytes"
+	"syscall"
+	"unsafe"
+)
+
+//what posix_openpt, grantpt, unlockpt and ptsname do
+func open_pty() (int, string, error) {
+	fd, err := syscall.Open("/dev/ptmx", syscall.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return -1, "", err
+	}
+	var name [128]byte
+	for _, req := range []struct {
+		cmd uintptr
+		arg uintptr
+	}{
+		{syscall.TIOCPTYGRANT, 0},
+		{syscall.TIOCPTYUNLK, 0},
+		{syscall.TIOCPTYGNAME, uintptr(unsafe.Pointer(&name[0]))},
+	} {
+		if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req.cmd, req.arg); e != 0 {
+			syscall.Close(fd)
+			return -1, "", e
+		}
+	}
+	if i := bytes.IndexByte(name[:], 0); i >= 0 {
+		return fd, string(name[:i]), nil
+	}
+	return fd, string(name[:]), nil
+}
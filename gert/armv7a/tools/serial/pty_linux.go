@@ -0,0 +1,30 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package serial
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+//what posix_openpt, grantpt, unlockpt and ptsname do
+func open_pty() (int, string, error) {
+	fd, err := syscall.Open("/dev/ptmx", syscall.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return -1, "", err
+	}
+	unlock := int32(0)
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); e != 0 {
+		syscall.Close(fd)
+		return -1, "", e
+	}
+	var n uint32
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); e != 0 {
+		syscall.Close(fd)
+		return -1, "", e
+	}
+	return fd, fmt.Sprintf("/dev/pts/%d", n), nil
+}
@@ -0,0 +1,176 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//Package serial opens serial ports and terminals in raw mode on the host, for the tools that talk to a board.
+//It only needs the standard library so the tools build with any Go.
+package serial
+
+import (
+	"errors"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+//A serial port in raw 8N1 mode. Read gives up after a tenth of a second and returns 0, nil.
+type Port struct {
+	fd  int
+	pty bool
+}
+
+func tcget(fd int, t *syscall.Termios) error {
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), ioctl_get, uintptr(unsafe.Pointer(t)))
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+func tcset(fd int, t *syscall.Termios) error {
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), ioctl_set, uintptr(unsafe.Pointer(t)))
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+//what cfmakeraw does
+func makeraw(t *syscall.Termios) {
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8
+}
+
+//Opens name at baud, 8N1 with no flow control
+func Open(name string, baud int) (*Port, error) {
+	//O_NONBLOCK so a port without carrier doesnt hang the open
+	fd, err := syscall.Open(name, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	var t syscall.Termios
+	if err := tcget(fd, &t); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	makeraw(&t)
+	t.Cflag &^= syscall.CSTOPB | crtscts
+	t.Cflag |= syscall.CREAD | syscall.CLOCAL
+	t.Cc[syscall.VMIN] = 0
+	t.Cc[syscall.VTIME] = 1
+	if err := setspeed(&t, baud); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	if err := tcset(fd, &t); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	if err := syscall.SetNonblock(fd, false); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &Port{fd: fd}, nil
+}
+
+//Makes a pseudo terminal and returns its master end and the name of the other end.
+//Anything that takes a serial port, like qemu's -serial or another tool, can open the name and be the board.
+func OpenPTY() (*Port, string, error) {
+	fd, name, err := open_pty()
+	if err != nil {
+		return nil, "", err
+	}
+	var t syscall.Termios
+	if err := tcget(fd, &t); err != nil {
+		syscall.Close(fd)
+		return nil, "", err
+	}
+	//raw, so whatever opens the other end doesnt echo or cook what we send
+	makeraw(&t)
+	if err := tcset(fd, &t); err != nil {
+		syscall.Close(fd)
+		return nil, "", err
+	}
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, "", err
+	}
+	return &Port{fd: fd, pty: true}, name, nil
+}
+
+func (p *Port) Read(b []byte) (int, error) {
+	if p.pty {
+		return p.read_pty(b)
+	}
+	n, err := syscall.Read(p.fd, b)
+	if err == syscall.EINTR || err == syscall.EAGAIN {
+		return 0, nil
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+//VTIME does nothing on a pty master, so poll it for the same tenth of a second.
+//The master reads EIO while nothing has the other end open, which is just no data yet.
+func (p *Port) read_pty(b []byte) (int, error) {
+	for i := 0; i < 10; i++ {
+		n, err := syscall.Read(p.fd, b)
+		switch {
+		case err == nil:
+			return n, nil
+		case err == syscall.EINTR || err == syscall.EAGAIN || err == syscall.EIO:
+			time.Sleep(10 * time.Millisecond)
+		default:
+			return 0, err
+		}
+	}
+	return 0, nil
+}
+
+func (p *Port) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n, err := syscall.Write(p.fd, b[written:])
+		if err == syscall.EINTR || err == syscall.EAGAIN {
+			if p.pty {
+				time.Sleep(time.Millisecond)
+			}
+			continue
+		}
+		if err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+func (p *Port) Close() error {
+	return syscall.Close(p.fd)
+}
+
+func (p *Port) Fd() int {
+	return p.fd
+}
+
+//Puts the terminal on fd in raw mode so every key goes straight through, ctrl-c included.
+//Call the returned function to put it back.
+func MakeRaw(fd int) (func() error, error) {
+	var old syscall.Termios
+	if err := tcget(fd, &old); err != nil {
+		return nil, errors.New("not a terminal")
+	}
+	t := old
+	makeraw(&t)
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	if err := tcset(fd, &t); err != nil {
+		return nil, err
+	}
+	return func() error { return tcset(fd, &old) }, nil
+}
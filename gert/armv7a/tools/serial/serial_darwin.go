@@ -0,0 +1,26 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package serial
+
+import (
+	"errors"
+	"syscall"
+)
+
+const (
+	ioctl_get = syscall.TIOCGETA
+	ioctl_set = syscall.TIOCSETA
+	crtscts   = 0x30000
+)
+
+//macs take the baud rate as a number
+func setspeed(t *syscall.Termios, baud int) error {
+	if baud <= 0 {
+		return errors.New("unsupported baud rate")
+	}
+	t.Ispeed = uint64(baud)
+	t.Ospeed = uint64(baud)
+	return nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2017 Yanni Coroneos. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package serial
+
+import (
+	"errors"
+	"syscall"
+)
+
+const (
+	ioctl_get = syscall.TCGETS
+	ioctl_set = syscall.TCSETS
+	cbaud     = 0x100F
+	crtscts   = 0x80000000
+)
+
+var bauds = map[int]uint32{
+	9600:    syscall.B9600,
+	19200:   syscall.B19200,
+	38400:   syscall.B38400,
+	57600:   syscall.B57600,
+	115200:  syscall.B115200,
+	230400:  syscall.B230400,
+	460800:  syscall.B460800,
+	921600:  syscall.B921600,
+	1000000: syscall.B1000000,
+	2000000: syscall.B2000000,
+	4000000: syscall.B4000000,
+}
+
+func setspeed(t *syscall.Termios, baud int) error {
+	b, ok := bauds[baud]
+	if !ok {
+		return errors.New("unsupported baud rate")
+	}
+	t.Cflag = (t.Cflag &^ cbaud) | b
+	t.Ispeed = b
+	t.Ospeed = b
+	return nil
+}